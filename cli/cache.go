@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	mdath "mdath/lib"
+	"mdath/lib/handlers"
+	"mdath/log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Run one of the cache administration commands (e.g. `cheetah cache purge --chapter=...`) against the admin listener of a running instance.
+func runCacheCommand(command string, args []string) {
+	cmd := flag.NewFlagSet("cache "+command, flag.ExitOnError)
+	cmd.StringVar(&adminAddress, "admin", "127.0.0.1:8001", "Address of the admin listener of the running instance, e.g. 127.0.0.1:8001 or unix:/run/cheetah.sock")
+	cmd.StringVar(&adminToken, "admin-token", os.Getenv("CHEETAH_ADMIN_TOKEN"), "Bearer token for the admin listener (defaults to $CHEETAH_ADMIN_TOKEN).")
+
+	var method, endpoint string
+	query := url.Values{}
+	switch command {
+	case "lookup":
+		cmd.Usage = func() {
+			fmt.Fprintln(cmd.Output(), "Usage: cheetah cache lookup [options] <image hash|image path>")
+			cmd.PrintDefaults()
+		}
+		cmd.Parse(args)
+		if cmd.NArg() != 1 {
+			cmd.Usage()
+			os.Exit(2)
+		}
+		method, endpoint = http.MethodGet, "/cache/lookup"
+		query.Set("image", cmd.Arg(0))
+	case "purge":
+		image := cmd.String("image", "", "Purge a single image by hash or path.")
+		chapter := cmd.String("chapter", "", "Purge all cached images of a chapter by chapter hash.")
+		prefix := cmd.String("prefix", "", "Purge all cached images whose hash starts with the given prefix (1-4 characters).")
+		cmd.Parse(args)
+		for key, value := range map[string]string{"image": *image, "chapter": *chapter, "prefix": *prefix} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		if len(query) != 1 {
+			log.Error("Exactly one of --image, --chapter or --prefix must be provided")
+			os.Exit(2)
+		}
+		method, endpoint = http.MethodPost, "/cache/purge"
+	case "usage":
+		cmd.Parse(args)
+		method, endpoint = http.MethodGet, "/cache/usage"
+	case "verify":
+		runCacheVerify(args)
+		return
+	default:
+		log.Error("Unknown cache command", command, "(available: lookup, purge, usage, verify)")
+		os.Exit(2)
+	}
+
+	status, err := adminRequest(method, endpoint, query, os.Stdout)
+	if err != nil {
+		log.Error("Failed to connect to admin listener", adminAddress, err)
+		os.Exit(1)
+	}
+	if status != http.StatusOK {
+		log.Error("Request to admin listener responded with status", status)
+		os.Exit(1)
+	}
+}
+
+// Verify all images of a cache directory (offline, no running instance required) and handle the corrupted images.
+func runCacheVerify(args []string) {
+	cmd := flag.NewFlagSet("cache verify", flag.ExitOnError)
+	cacheFlags(cmd)
+	quarantine := cmd.String("quarantine", "", "Move corrupted images into this directory.")
+	remove := cmd.Bool("delete", false, "Delete corrupted images.")
+	minAge := cmd.Duration("min-age", 0, "Skip images which were modified more recently (e.g. when verifying the cache of a running instance).")
+	cmd.StringVar(&logfile, "log-file", "", "Destination of log output. If not provided stdout/stderr will be used.")
+	cmd.StringVar(&loglevel, "log-level", "info", "Granularity of logging [error, warn, info, verbose]")
+	cmd.Parse(args)
+
+	logup()
+
+	options := handlers.VerifyOptions{
+		Action: handlers.VerifyOnly,
+		MinAge: *minAge,
+		Progress: func(report handlers.VerifyReport) {
+			log.Info("Verify:", report.Checked, "images checked,", report.Corrupted, "corrupted")
+		},
+	}
+	if *quarantine != "" && *remove {
+		log.Error("Only one of --quarantine or --delete can be provided")
+		os.Exit(2)
+	} else if *quarantine != "" {
+		options.Action, options.Quarantine = handlers.VerifyQuarantine, *quarantine
+	} else if *remove {
+		options.Action = handlers.VerifyDelete
+	}
+
+	cache := createFileCache(&upstreamServer, new(mdath.RequestValidator))
+	report, err := cache.Verify(options)
+	if err != nil {
+		log.Error("Failed to verify cache", cacheDirectory, err)
+		os.Exit(1)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if report.Corrupted > 0 {
+		os.Exit(1)
+	}
+}
+
+// Send a request to the admin listener and copy the response body to the given output.
+func adminRequest(method string, endpoint string, query url.Values, output io.Writer) (status int, err error) {
+	host := adminAddress
+	transport := &http.Transport{}
+	if strings.HasPrefix(adminAddress, "unix:") {
+		socket := strings.TrimPrefix(adminAddress, "unix:")
+		host = "localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", socket)
+		}
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Minute,
+	}
+	request, err := http.NewRequest(method, "http://"+host+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return
+	}
+	request.Header.Set("Authorization", "Bearer "+adminToken)
+	response, err := client.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	status = response.StatusCode
+	_, err = io.Copy(output, response.Body)
+	return
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	mdath "mdath/lib"
+	"mdath/lib/handlers"
+	"mdath/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var importModes = map[string]handlers.ImportMode{
+	"copy": handlers.ImportCopy,
+	"move": handlers.ImportMove,
+	"link": handlers.ImportLink,
+}
+
+// Import the cache of the official MangaDex@Home client (or any directory of raw images) into the cache layout.
+func startImport() {
+	cmd := flag.NewFlagSet("import", flag.ExitOnError)
+	source := cmd.String("source", "", "Cache directory of the official MangaDex@Home client (e.g. ./images).")
+	cacheFlags(cmd)
+	mode := cmd.String("mode", "copy", "How images are transferred into the cache [copy, move, link].")
+	dryRun := cmd.Bool("dry-run", false, "Only verify the images and report what would be imported.")
+	state := cmd.String("state", "", "File for tracking processed images, so an interrupted import can be resumed (disabled if not provided).")
+	interval := cmd.Duration("progress-interval", 10*time.Second, "Interval for reporting the progress.")
+	cmd.StringVar(&logfile, "log-file", "", "Destination of log output. If not provided stdout/stderr will be used.")
+	cmd.StringVar(&loglevel, "log-level", "info", "Granularity of logging [error, warn, info, verbose]")
+
+	cmd.Parse(os.Args[2:])
+
+	logup()
+
+	options := handlers.ImportOptions{DryRun: *dryRun}
+	var ok bool
+	if options.Mode, ok = importModes[*mode]; !ok {
+		log.Error("Invalid option for mode", *mode)
+		os.Exit(2)
+	}
+	if *source == "" {
+		log.Error("Missing source directory")
+		os.Exit(2)
+	}
+	processed, err := openJournal(*state)
+	if err != nil {
+		log.Error("Failed to open state file", *state, err)
+		os.Exit(1)
+	}
+	defer processed.close()
+
+	cache := createFileCache(&upstreamServer, new(mdath.RequestValidator))
+	var scanned, imported, skipped, failed int64
+	stop := reportProgress(*interval, func(elapsed time.Duration) {
+		prefix := "Import"
+		if options.DryRun {
+			prefix = "Import (dry-run)"
+		}
+		log.Info(fmt.Sprintf("%s: %d scanned, %d imported, %d skipped, %d failed in %s", prefix,
+			atomic.LoadInt64(&scanned),
+			atomic.LoadInt64(&imported),
+			atomic.LoadInt64(&skipped),
+			atomic.LoadInt64(&failed),
+			elapsed.Round(time.Second)))
+	})
+
+	err = filepath.WalkDir(*source, func(location string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".db") || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		atomic.AddInt64(&scanned, 1)
+		if processed.contains(location) {
+			atomic.AddInt64(&skipped, 1)
+			return nil
+		}
+		file, ok, err := cache.ImportImage(location, options)
+		if err != nil {
+			atomic.AddInt64(&failed, 1)
+			log.Warn("Failed to import image", location, err)
+			return nil
+		}
+		if ok {
+			atomic.AddInt64(&imported, 1)
+			log.Verbose("Imported image", location, "=>", file)
+		} else {
+			atomic.AddInt64(&skipped, 1)
+		}
+		if !options.DryRun {
+			processed.add(location)
+		}
+		return nil
+	})
+	stop()
+	if err != nil {
+		log.Error("Failed to walk source directory", *source, err)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	mdath "mdath/lib"
+	"mdath/lib/handlers"
+	"mdath/log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type prefetchStatistics struct {
+	queued  int64
+	fetched int64
+	skipped int64
+	failed  int64
+	bytes   int64
+}
+
+// Warm up the cache by fetching the images listed in the given inputs (plain image paths, image URLs or access logs) from the upstream server.
+func startPrefetch() {
+	cmd := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	cmd.StringVar(&upstreamServer, "upstream", "https://uploads.mangadex.org", "Upstream server from which the images are fetched.")
+	cacheFlags(cmd)
+	upstreamFlags(cmd)
+	concurrency := cmd.Int("concurrency", 8, "Max. number of images which are fetched in parallel.")
+	state := cmd.String("state", "", "File for tracking completed images, so an interrupted prefetch can be resumed (disabled if not provided).")
+	interval := cmd.Duration("progress-interval", 10*time.Second, "Interval for reporting the progress.")
+	cmd.StringVar(&logfile, "log-file", "", "Destination of log output. If not provided stdout/stderr will be used.")
+	cmd.StringVar(&loglevel, "log-level", "info", "Granularity of logging [error, warn, info, verbose]")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: cheetah prefetch [options] [file ...]")
+		fmt.Fprintln(cmd.Output(), "Each line of the input files (or stdin if no file or '-' is given) may contain an image path, an image URL or an access log entry.")
+		cmd.PrintDefaults()
+	}
+
+	cmd.Parse(os.Args[2:])
+
+	logup()
+
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+	completed, err := openJournal(*state)
+	if err != nil {
+		log.Error("Failed to open state file", *state, err)
+		os.Exit(1)
+	}
+	defer completed.close()
+
+	validator := new(mdath.RequestValidator)
+	validator.Update(true, "")
+	cache := createFileCache(&upstreamServer, validator)
+
+	statistics := new(prefetchStatistics)
+	stop := reportProgress(*interval, func(elapsed time.Duration) {
+		log.Info(fmt.Sprintf("Prefetch: %d queued, %d fetched, %d skipped, %d failed, %.1f MB in %s",
+			atomic.LoadInt64(&statistics.queued),
+			atomic.LoadInt64(&statistics.fetched),
+			atomic.LoadInt64(&statistics.skipped),
+			atomic.LoadInt64(&statistics.failed),
+			float64(atomic.LoadInt64(&statistics.bytes))/1048576,
+			elapsed.Round(time.Second)))
+	})
+
+	images := make(chan handlers.ImagePath, *concurrency)
+	workers := new(sync.WaitGroup)
+	for i := 0; i < *concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for image := range images {
+				fetched, size, err := cache.Prefetch(image)
+				if err != nil {
+					atomic.AddInt64(&statistics.failed, 1)
+					log.Warn("Failed to prefetch image", image, err)
+					continue
+				}
+				if fetched {
+					atomic.AddInt64(&statistics.fetched, 1)
+					atomic.AddInt64(&statistics.bytes, size)
+					log.Verbose("Prefetched image", image)
+				} else {
+					atomic.AddInt64(&statistics.skipped, 1)
+				}
+				completed.add(image.File())
+			}
+		}()
+	}
+
+	inputs := cmd.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	queued := make(map[string]bool)
+	for _, input := range inputs {
+		err = readImagePaths(input, func(image handlers.ImagePath) {
+			if queued[image.File()] {
+				return
+			}
+			queued[image.File()] = true
+			atomic.AddInt64(&statistics.queued, 1)
+			if completed.contains(image.File()) {
+				atomic.AddInt64(&statistics.skipped, 1)
+				return
+			}
+			images <- image
+		})
+		if err != nil {
+			log.Error("Failed to read input", input, err)
+		}
+	}
+	close(images)
+	workers.Wait()
+	stop()
+
+	if atomic.LoadInt64(&statistics.failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// Invoke the callback for each image path found in the lines of the given file (or stdin for '-').
+func readImagePaths(input string, callback func(image handlers.ImagePath)) (err error) {
+	var reader io.Reader = os.Stdin
+	if input != "-" {
+		file, e := os.Open(input)
+		if e != nil {
+			return e
+		}
+		defer file.Close()
+		reader = file
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if image, e := handlers.ParseImagePath(scanner.Text()); e == nil {
+			callback(image)
+		}
+	}
+	return scanner.Err()
+}
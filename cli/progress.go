@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Append-only list of completed items, allowing long running commands to resume where they were interrupted.
+type journal struct {
+	file  *os.File
+	done  map[string]bool
+	mutex sync.Mutex
+}
+
+// Load the list of completed items from the given file (an empty path disables persistence).
+func openJournal(path string) (instance *journal, err error) {
+	instance = &journal{
+		done: make(map[string]bool),
+	}
+	if path == "" {
+		return
+	}
+	instance.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(instance.file)
+	for scanner.Scan() {
+		instance.done[scanner.Text()] = true
+	}
+	err = scanner.Err()
+	return
+}
+
+func (instance *journal) contains(item string) bool {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	return instance.done[item]
+}
+
+func (instance *journal) add(item string) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.done[item] = true
+	if instance.file != nil {
+		fmt.Fprintln(instance.file, item)
+	}
+}
+
+func (instance *journal) close() {
+	if instance.file != nil {
+		instance.file.Close()
+	}
+}
+
+// Invoke the report function periodically until the returned stop function is called (which reports one last time).
+func reportProgress(interval time.Duration, report func(elapsed time.Duration)) (stop func()) {
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report(time.Since(start))
+			case <-done:
+				report(time.Since(start))
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -2,4 +2,4 @@ module mdath
 
 go 1.16
 
-require golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
+require golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
@@ -0,0 +1,206 @@
+package mdath
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mdath/log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+type statusReport struct {
+	name   string
+	report func() interface{}
+}
+
+// Administrative HTTP server (e.g. for load balancers and orchestrators) which is running independently from the ImageServer.
+type AdminServer struct {
+	server   *http.Server
+	mux      *http.ServeMux
+	token    string
+	checks   []readinessCheck
+	notices  []readinessCheck
+	reports  []statusReport
+	draining int32
+	mutex    sync.RWMutex
+}
+
+// Instantiate a new AdminServer.
+// The health, readiness and status endpoints are public, all other endpoints require the given token as bearer authorization (and are disabled if the token is empty).
+func CreateAdminServer(token string) (instance *AdminServer) {
+	instance = &AdminServer{
+		mux:   http.NewServeMux(),
+		token: token,
+	}
+	instance.mux.HandleFunc("/healthz", instance.serveHealth)
+	instance.mux.HandleFunc("/readyz", instance.serveReadiness)
+	instance.mux.HandleFunc("/status", instance.serveStatus)
+	return
+}
+
+// Register a check which must pass before the node is reported as ready.
+func (instance *AdminServer) AddReadinessCheck(name string, check func() error) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.checks = append(instance.checks, readinessCheck{name, check})
+}
+
+// Register a check which is only reported as warning by the health endpoint (e.g. degraded operation which doesn't require a restart).
+func (instance *AdminServer) AddHealthNotice(name string, check func() error) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.notices = append(instance.notices, readinessCheck{name, check})
+}
+
+// Register a section which is included (under the given name) in the JSON response of the status endpoint.
+func (instance *AdminServer) AddStatusReport(name string, report func() interface{}) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.reports = append(instance.reports, statusReport{name, report})
+}
+
+// Register a handler for an endpoint which requires authorization.
+func (instance *AdminServer) Handle(pattern string, handler http.Handler) {
+	instance.mux.Handle(pattern, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !instance.authorized(request) {
+			log.Warn("Admin Request (Unauthorized):", request.RemoteAddr, "=>", request.URL.Path)
+			response.Header().Set("WWW-Authenticate", "Bearer")
+			response.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		log.Info("Admin Request:", request.RemoteAddr, "=>", request.Method, request.URL.RequestURI())
+		handler.ServeHTTP(response, request)
+	}))
+}
+
+func (instance *AdminServer) authorized(request *http.Request) bool {
+	if instance.token == "" {
+		return false
+	}
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(instance.token)) == 1
+}
+
+// Report the node as not ready from now on (e.g. while shutting down), so load balancers stop routing new traffic to it.
+func (instance *AdminServer) Drain() {
+	atomic.StoreInt32(&instance.draining, 1)
+}
+
+func (instance *AdminServer) serveHealth(response http.ResponseWriter, request *http.Request) {
+	instance.mutex.RLock()
+	notices := instance.notices
+	instance.mutex.RUnlock()
+
+	lines := []string{"ok"}
+	for _, item := range notices {
+		if err := item.check(); err != nil {
+			lines = append(lines, "[WARN] "+item.name+": "+err.Error())
+		}
+	}
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(http.StatusOK)
+	response.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+func (instance *AdminServer) serveReadiness(response http.ResponseWriter, request *http.Request) {
+	instance.mutex.RLock()
+	checks := instance.checks
+	instance.mutex.RUnlock()
+
+	status := http.StatusOK
+	lines := make([]string, 0, len(checks)+1)
+	if atomic.LoadInt32(&instance.draining) != 0 {
+		status = http.StatusServiceUnavailable
+		lines = append(lines, "[FAIL] draining: shutting down")
+	}
+	for _, item := range checks {
+		if err := item.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			lines = append(lines, "[FAIL] "+item.name+": "+err.Error())
+		} else {
+			lines = append(lines, "[ OK ] "+item.name)
+		}
+	}
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(status)
+	response.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+func (instance *AdminServer) serveStatus(response http.ResponseWriter, request *http.Request) {
+	instance.mutex.RLock()
+	reports := instance.reports
+	instance.mutex.RUnlock()
+
+	data := make(map[string]interface{}, len(reports))
+	for _, item := range reports {
+		data[item.name] = item.report()
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(data)
+}
+
+// Start listening on the given address, which is either a TCP address (e.g. "127.0.0.1:8001") or a unix domain socket (e.g. "unix:/run/cheetah.sock").
+func (instance *AdminServer) Start(address string) (err error) {
+	if instance.server != nil {
+		return
+	}
+	var listener net.Listener
+	if strings.HasPrefix(address, "unix:") {
+		socket := strings.TrimPrefix(address, "unix:")
+		if err = removeStaleSocket(socket); err != nil {
+			log.Error("Failed to remove stale admin socket", err)
+			return
+		}
+		listener, err = net.Listen("unix", socket)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		log.Error("Failed to start Admin Server", err)
+		return
+	}
+	server := &http.Server{
+		Handler:           instance.mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		IdleTimeout:       1 * time.Minute,
+	}
+	instance.server = server
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Admin Server terminated unexpectedly", err)
+		}
+	}()
+	log.Info("Started Admin Server on", address)
+	return
+}
+
+func (instance *AdminServer) Stop(ctx context.Context) (err error) {
+	if instance.server == nil {
+		return
+	}
+	err = instance.server.Shutdown(ctx)
+	if err != nil {
+		instance.server.Close()
+	}
+	instance.server = nil
+	log.Info("Stopped Admin Server")
+	return
+}
@@ -0,0 +1,41 @@
+package mdath
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminServerKeepsFilesAtTheSocketPath(t *testing.T) {
+	directory := t.TempDir()
+	file := filepath.Join(directory, "config.yml")
+	if err := os.WriteFile(file, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if CreateAdminServer("").Start("unix:"+file) == nil {
+		t.Fatal("admin server replaced a regular file by its socket")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep me" {
+		t.Fatal("regular file removed:", err)
+	}
+
+	socket := filepath.Join(directory, "admin.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	server := CreateAdminServer("")
+	if err = server.Start("unix:" + socket); err != nil {
+		t.Fatal("stale socket not replaced:", err)
+	}
+	defer server.Stop(context.Background())
+	connection, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal("admin server not listening on the socket:", err)
+	}
+	connection.Close()
+}
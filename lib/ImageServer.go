@@ -1,11 +1,16 @@
 package mdath
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"mdath/log"
 	"net"
 	"net/http"
+	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -15,6 +20,11 @@ type ImageServer struct {
 	handler     http.Handler
 	tlsProvider *TLSProvider
 	connections int64
+	responses   int64
+	listening   int32
+	listeners   int
+	trusted     []*net.IPNet
+	done        chan error
 }
 
 func CreateImageServer(TLSProvider *TLSProvider, handler http.Handler) *ImageServer {
@@ -34,16 +44,243 @@ func (instance *ImageServer) updateConnectionCount(conn net.Conn, state http.Con
 	//log.Debug("State:", state, ", Open Connections:", atomic.LoadInt64(&instance.connections))
 }
 
-func (instance *ImageServer) Start(port int, workers int, nossl bool) (err error) {
+// Keep track of the responses which are currently in-flight (a single keep-alive connection may carry several of them over time).
+func (instance *ImageServer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	atomic.AddInt64(&instance.responses, 1)
+	defer atomic.AddInt64(&instance.responses, -1)
+	if len(instance.trusted) > 0 {
+		request.RemoteAddr = instance.clientAddress(request)
+	}
+	instance.handler.ServeHTTP(response, request)
+}
+
+// Number of currently open client connections.
+func (instance *ImageServer) Connections() int64 {
+	return atomic.LoadInt64(&instance.connections)
+}
+
+// Number of responses which are currently being processed or transferred.
+func (instance *ImageServer) Responses() int64 {
+	return atomic.LoadInt64(&instance.responses)
+}
+
+// Verify that the server is accepting connections.
+func (instance *ImageServer) CheckListener() error {
+	if atomic.LoadInt32(&instance.listening) == 0 {
+		return errors.New("not accepting connections")
+	}
+	return nil
+}
+
+// Address on which the ImageServer accepts connections.
+type Listener struct {
+	Network       string // tcp (dual-stack), tcp4, tcp6 or unix
+	Address       string // host:port or the path of the unix domain socket
+	TLS           bool
+	ProxyProtocol bool // connections start with a PROXY protocol header (v1 or v2)
+}
+
+func (listener Listener) String() string {
+	prefix := ""
+	if listener.ProxyProtocol {
+		prefix = "proxy+"
+	}
+	if listener.Network == "unix" {
+		return prefix + "unix:" + listener.Address
+	}
+	if listener.TLS {
+		return prefix + "https://" + listener.Address
+	}
+	return prefix + "http://" + listener.Address
+}
+
+// Parse a listener given as https://HOST:PORT, http://HOST:PORT or unix:PATH (plain HTTP), prefixed with proxy+ for the PROXY protocol.
+// IPv4 hosts only accept IPv4, IPv6 hosts only IPv6 (e.g. [::]) and an empty host accepts both (e.g. https://:443).
+func ParseListener(value string) (listener Listener, err error) {
+	specification := value
+	if strings.HasPrefix(specification, "proxy+") {
+		listener.ProxyProtocol, specification = true, strings.TrimPrefix(specification, "proxy+")
+	}
+	if strings.HasPrefix(specification, "unix:") {
+		listener.Network, listener.Address = "unix", strings.TrimPrefix(specification, "unix:")
+		if listener.Address == "" {
+			err = errors.New("missing path of the unix domain socket")
+		}
+		return
+	}
+	switch {
+	case strings.HasPrefix(specification, "https://"):
+		listener.TLS, listener.Address = true, strings.TrimPrefix(specification, "https://")
+	case strings.HasPrefix(specification, "http://"):
+		listener.Address = strings.TrimPrefix(specification, "http://")
+	default:
+		err = fmt.Errorf("listener %q must start with https://, http:// or unix:", value)
+		return
+	}
+	host, port, err := net.SplitHostPort(listener.Address)
+	if err != nil {
+		return
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		err = fmt.Errorf("invalid port of listener %q", value)
+		return
+	}
+	listener.Network = listenerNetwork(host)
+	if host != "" && net.ParseIP(host) == nil {
+		err = fmt.Errorf("host of listener %q must be an IP address", value)
+	}
+	return
+}
+
+// The listener for the given IP address (all addresses if empty) and port.
+func DefaultListener(ip string, port int, tls bool) Listener {
+	return Listener{
+		Network: listenerNetwork(ip),
+		Address: net.JoinHostPort(ip, strconv.Itoa(port)),
+		TLS:     tls,
+	}
+}
+
+func listenerNetwork(host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// Remove the socket of a previous run, any other file and sockets which still accept connections are kept.
+func removeStaleSocket(address string) error {
+	info, err := os.Lstat(address)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("path of the unix domain socket %q exists and is not a socket", address)
+	}
+	if connection, err := net.DialTimeout("unix", address, time.Second); err == nil {
+		connection.Close()
+		return fmt.Errorf("unix domain socket %q is in use by another process", address)
+	}
+	return os.Remove(address)
+}
+
+func (instance *ImageServer) listen(listener Listener) (net.Listener, error) {
+	if listener.Network == "unix" {
+		if err := removeStaleSocket(listener.Address); err != nil {
+			return nil, err
+		}
+	}
+	if listener.TLS {
+		return instance.tlsProvider.CreateListener(listener.Network, listener.Address, listener.ProxyProtocol)
+	}
+	opened, err := net.Listen(listener.Network, listener.Address)
+	if err == nil && listener.ProxyProtocol {
+		opened = &proxyListener{opened}
+	}
+	return opened, err
+}
+
+// Trust the X-Forwarded-For and X-Real-IP headers of requests from the given networks (e.g. reverse proxies and CDNs).
+// Requests received on unix domain sockets are always trusted once any network is trusted.
+func (instance *ImageServer) TrustProxies(networks []*net.IPNet) {
+	instance.trusted = networks
+}
+
+func (instance *ImageServer) trusts(ip net.IP) bool {
+	for _, network := range instance.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine the address of the client, which is the last address of the X-Forwarded-For chain not belonging to a trusted proxy.
+func (instance *ImageServer) clientAddress(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err == nil {
+		if ip := net.ParseIP(host); ip == nil || !instance.trusts(ip) {
+			return request.RemoteAddr
+		}
+	}
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	if len(request.Header.Values("X-Forwarded-For")) == 0 {
+		forwarded = []string{request.Header.Get("X-Real-IP")}
+	}
+	var client net.IP
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		if client = ip; !instance.trusts(ip) {
+			break
+		}
+	}
+	if client == nil {
+		return request.RemoteAddr
+	}
+	return net.JoinHostPort(client.String(), "0")
+}
+
+// Parse a comma separated list of IP addresses and networks in CIDR notation.
+func ParseTrustedProxies(value string) (networks []*net.IPNet, err error) {
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, parseErr := net.ParseCIDR(entry)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// Start serving images on the given listeners and block until the server is accepting connections on all of them (or failed to do so).
+func (instance *ImageServer) Start(listeners []Listener, workers int) (err error) {
 	if instance.server != nil {
 		return
 	}
+	if len(listeners) == 0 {
+		err = errors.New("no listener configured")
+		log.Error("Failed to start Image Cache Server", err)
+		return
+	}
 
 	runtime.GOMAXPROCS(workers)
+	ready := make(chan struct{}, len(listeners))
+	instance.done = make(chan error, len(listeners))
+	instance.listeners = len(listeners)
 	instance.server = &http.Server{
-		Addr:      ":" + strconv.Itoa(port),
 		ConnState: instance.updateConnectionCount,
-		Handler:   instance.handler,
+		Handler:   instance,
+		BaseContext: func(net.Listener) context.Context {
+			// invoked by Serve right before entering the accept loop
+			ready <- struct{}{}
+			return context.Background()
+		},
 		//ErrorLog:     logger,
 		ReadHeaderTimeout: 15 * time.Second,
 		ReadTimeout:       30 * time.Second,
@@ -51,43 +288,76 @@ func (instance *ImageServer) Start(port int, workers int, nossl bool) (err error
 		IdleTimeout:       1 * time.Minute,
 	}
 
-	var listener net.Listener
-	if nossl {
-		listener, err = net.Listen("tcp4", instance.server.Addr)
-	} else {
-		listener, err = instance.tlsProvider.CreateListener("tcp4", instance.server.Addr)
+	opened := make([]net.Listener, 0, len(listeners))
+	for _, config := range listeners {
+		var listener net.Listener
+		if listener, err = instance.listen(config); err != nil {
+			for _, listener := range opened {
+				listener.Close()
+			}
+			instance.server = nil
+			log.Error("Failed to start Image Cache Server on", config, err)
+			return
+		}
+		opened = append(opened, listener)
 	}
-	if err != nil {
-		log.Error("Failed to start Image Cache Server", err)
-		return
+	for _, listener := range opened {
+		go func(listener net.Listener) {
+			instance.done <- instance.server.Serve(listener)
+		}(listener)
 	}
-	go func() {
-		err = instance.server.Serve(listener)
-	}()
-	time.Sleep(2500 * time.Millisecond)
-	if err == nil {
-		log.Info("Started Image Cache Server on", port)
+	for range opened {
+		select {
+		case <-ready:
+		case err = <-instance.done:
+			instance.server.Close()
+			instance.server = nil
+			log.Error("Failed to start Image Cache Server", err)
+			return
+		}
+	}
+	atomic.StoreInt32(&instance.listening, 1)
+	for _, config := range listeners {
+		log.Info("Started Image Cache Server on", config)
 	}
 	return
 }
 
-func (instance *ImageServer) Stop(timeout time.Duration, interval time.Duration) (err error) {
+// Stop accepting new connections and wait until all in-flight responses are completed.
+// When the context expires before all responses are completed, the remaining connections are closed forcefully.
+func (instance *ImageServer) Stop(ctx context.Context, interval time.Duration) (err error) {
 	if instance.server == nil {
 		return
 	}
+	atomic.StoreInt32(&instance.listening, 0)
 	instance.server.SetKeepAlivesEnabled(false)
-	for remaining := timeout; remaining > 0; remaining -= interval {
-		log.Info("Waiting for", instance.connections, "connection(s) before stopping the Image Cache Server in", remaining)
-		time.Sleep(interval)
-		if instance.connections == 0 {
-			log.Info("No open connection(s), stopping the Image Cache Server now")
-			remaining = 0
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- instance.server.Shutdown(ctx)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-ticker.C:
+			log.Info("Waiting for", instance.Responses(), "response(s) on", instance.Connections(), "connection(s) before stopping the Image Cache Server")
+		case err = <-shutdown:
+			waiting = false
 		}
 	}
-	err = instance.server.Close()
 	if err != nil {
-		log.Error("Failed to stop the Image Cache Server")
-		return
+		log.Warn("Graceful shutdown period exceeded,", instance.Responses(), "response(s) will be aborted")
+		err = instance.server.Close()
+		if err != nil {
+			log.Error("Failed to stop the Image Cache Server", err)
+			return
+		}
+	}
+	for i := 0; i < instance.listeners; i++ {
+		if served := <-instance.done; !errors.Is(served, http.ErrServerClosed) {
+			log.Warn("Image Cache Server terminated unexpectedly", served)
+		}
 	}
 	instance.server = nil
 	log.Info("Stopped Image Cache Server")
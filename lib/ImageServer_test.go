@@ -0,0 +1,112 @@
+package mdath
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	directory := t.TempDir()
+	if err := removeStaleSocket(filepath.Join(directory, "missing.sock")); err != nil {
+		t.Fatal("missing socket:", err)
+	}
+
+	socket := filepath.Join(directory, "cheetah.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removeStaleSocket(socket) == nil {
+		t.Fatal("socket of a running process removed")
+	}
+	// keep the socket file like a crashed process would
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if err = removeStaleSocket(socket); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(socket); !os.IsNotExist(err) {
+		t.Fatal("stale socket not removed:", err)
+	}
+
+	file := filepath.Join(directory, "config.yml")
+	if err = os.WriteFile(file, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if removeStaleSocket(file) == nil {
+		t.Fatal("regular file replaced by the socket")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep me" {
+		t.Fatal("regular file removed:", err)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		trusted   []*net.IPNet
+		remote    string
+		forwarded []string // X-Forwarded-For headers
+		realIP    string
+		client    string
+	}{
+		{"no trusted proxies", nil, "198.51.100.1:1234", []string{"203.0.113.1"}, "", "198.51.100.1:1234"},
+		{"untrusted peer", trusted, "198.51.100.1:1234", []string{"203.0.113.1"}, "203.0.113.2", "198.51.100.1:1234"},
+		{"trusted network", trusted, "10.1.2.3:1234", []string{"203.0.113.1"}, "", "203.0.113.1:0"},
+		{"trusted address", trusted, "192.0.2.1:1234", []string{"203.0.113.1"}, "", "203.0.113.1:0"},
+		{"trusted IPv6 network", trusted, "[2001:db8::1]:1234", []string{"2001:db8:1::1, 2001:db9::1"}, "", "[2001:db9::1]:0"},
+		{"unix domain socket", trusted, "@", []string{"203.0.113.1"}, "", "203.0.113.1:0"},
+		{"last untrusted hop", trusted, "10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.7, 10.0.0.2"}, "", "198.51.100.7:0"},
+		{"multiple headers", trusted, "10.0.0.1:1234", []string{"203.0.113.1", "198.51.100.7", "10.0.0.2"}, "", "198.51.100.7:0"},
+		{"only trusted hops", trusted, "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3:0"},
+		{"invalid hop", trusted, "10.0.0.1:1234", []string{"203.0.113.1, garbage, 10.0.0.2"}, "", "10.0.0.2:0"},
+		{"invalid header", trusted, "10.0.0.1:1234", []string{"garbage"}, "", "10.0.0.1:1234"},
+		{"real IP", trusted, "10.0.0.1:1234", nil, "203.0.113.1", "203.0.113.1:0"},
+		{"forwarded for preferred over real IP", trusted, "10.0.0.1:1234", []string{"203.0.113.1"}, "203.0.113.2", "203.0.113.1:0"},
+		{"no headers", trusted, "10.0.0.1:1234", nil, "", "10.0.0.1:1234"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var client string
+			server := CreateImageServer(nil, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				client = request.RemoteAddr
+			}))
+			server.TrustProxies(test.trusted)
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = test.remote
+			for _, value := range test.forwarded {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+			if test.realIP != "" {
+				request.Header.Set("X-Real-IP", test.realIP)
+			}
+			server.ServeHTTP(httptest.NewRecorder(), request)
+			if client != test.client {
+				t.Fatalf("client address %s instead of %s", client, test.client)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := ParseTrustedProxies(" 10.0.0.0/8,,192.0.2.1 , ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 || networks[0].String() != "10.0.0.0/8" || networks[1].String() != "192.0.2.1/32" || networks[2].String() != "::1/128" {
+		t.Fatal("unexpected networks", networks)
+	}
+	for _, value := range []string{"10.0.0.0/33", "192.0.2", "proxy.example.com"} {
+		if _, err = ParseTrustedProxies(value); err == nil {
+			t.Error("invalid trusted proxy accepted:", value)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package mdath
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mdath/log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max. time a load balancer may take to send the PROXY protocol header
+	proxyHeaderTimeout = 5 * time.Second
+	// max. length of a PROXY protocol v1 header (including CRLF)
+	proxyHeaderLength int = 107
+)
+
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener which expects every connection to start with a PROXY protocol (v1 or v2) header, e.g. sent by L4 load balancers.
+// The header is parsed on the first use of the connection (not within Accept), so a slow client can't block the accept loop.
+type proxyListener struct {
+	net.Listener
+}
+
+func (instance *proxyListener) Accept() (net.Conn, error) {
+	connection, err := instance.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: connection}, nil
+}
+
+// Connection which reports the addresses of the PROXY protocol header instead of the addresses of the load balancer.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (instance *proxyConn) parse() {
+	instance.once.Do(func() {
+		instance.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		instance.remote, instance.local, instance.err = readProxyHeader(instance.Conn)
+		instance.Conn.SetReadDeadline(time.Time{})
+		if instance.err != nil {
+			log.Verbose("Invalid PROXY protocol header:", instance.Conn.RemoteAddr(), instance.err)
+			instance.err = fmt.Errorf("invalid PROXY protocol header: %w", instance.err)
+		}
+	})
+}
+
+func (instance *proxyConn) Read(buffer []byte) (int, error) {
+	if instance.parse(); instance.err != nil {
+		return 0, instance.err
+	}
+	return instance.Conn.Read(buffer)
+}
+
+// Keep sendfile available for plain HTTP connections (the header is never buffered, so the underlying connection can be used directly).
+func (instance *proxyConn) ReadFrom(reader io.Reader) (int64, error) {
+	if from, ok := instance.Conn.(io.ReaderFrom); ok {
+		return from.ReadFrom(reader)
+	}
+	return io.Copy(struct{ io.Writer }{instance.Conn}, reader)
+}
+
+func (instance *proxyConn) RemoteAddr() net.Addr {
+	if instance.parse(); instance.remote != nil {
+		return instance.remote
+	}
+	return instance.Conn.RemoteAddr()
+}
+
+func (instance *proxyConn) LocalAddr() net.Addr {
+	if instance.parse(); instance.local != nil {
+		return instance.local
+	}
+	return instance.Conn.LocalAddr()
+}
+
+// Read the PROXY protocol header without reading beyond it (nil addresses for LOCAL and UNKNOWN connections, e.g. health checks).
+func readProxyHeader(reader io.Reader) (remote net.Addr, local net.Addr, err error) {
+	head := make([]byte, len(proxySignature)+4)
+	if _, err = io.ReadFull(reader, head[:6]); err != nil {
+		return
+	}
+	if string(head[:6]) == "PROXY " {
+		return readProxyHeaderV1(reader)
+	}
+	if _, err = io.ReadFull(reader, head[6:]); err != nil {
+		return
+	}
+	if !bytes.Equal(head[:len(proxySignature)], proxySignature) {
+		err = errors.New("missing signature")
+		return
+	}
+	return readProxyHeaderV2(reader, head[len(proxySignature):])
+}
+
+// Parse the remainder of a v1 header (e.g. "TCP4 192.0.2.1 192.0.2.2 56324 443\r\n").
+func readProxyHeaderV1(reader io.Reader) (remote net.Addr, local net.Addr, err error) {
+	line := make([]byte, 0, proxyHeaderLength)
+	single := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyHeaderLength-6 {
+			err = errors.New("v1 header too long")
+			return
+		}
+		if _, err = io.ReadFull(reader, single); err != nil {
+			return
+		}
+		line = append(line, single[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		err = fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+		return
+	}
+	addresses := make([]net.Addr, 2)
+	for i := range addresses {
+		ip := net.ParseIP(fields[1+i])
+		port, parseErr := strconv.ParseUint(fields[3+i], 10, 16)
+		if ip == nil || parseErr != nil {
+			err = fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+			return
+		}
+		addresses[i] = &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	return addresses[0], addresses[1], nil
+}
+
+// Parse the remainder of a v2 header given the version/command, family and length bytes following the signature.
+func readProxyHeaderV2(reader io.Reader, head []byte) (remote net.Addr, local net.Addr, err error) {
+	if head[0]>>4 != 2 {
+		err = fmt.Errorf("unsupported version %d", head[0]>>4)
+		return
+	}
+	block := make([]byte, binary.BigEndian.Uint16(head[2:4]))
+	if _, err = io.ReadFull(reader, block); err != nil {
+		return
+	}
+	switch head[0] & 0x0F {
+	case 0x0: // LOCAL
+		return
+	case 0x1: // PROXY
+	default:
+		err = fmt.Errorf("unsupported command %d", head[0]&0x0F)
+		return
+	}
+	var size int
+	switch head[1] >> 4 {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default: // AF_UNSPEC and AF_UNIX
+		return
+	}
+	if len(block) < 2*size+4 {
+		err = errors.New("truncated v2 address block")
+		return
+	}
+	remote = &net.TCPAddr{IP: net.IP(block[0:size]), Port: int(binary.BigEndian.Uint16(block[2*size:]))}
+	local = &net.TCPAddr{IP: net.IP(block[size : 2*size]), Port: int(binary.BigEndian.Uint16(block[2*size+2:]))}
+	return
+}
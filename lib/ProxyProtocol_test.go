@@ -0,0 +1,114 @@
+package mdath
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Build a v2 header with the given version/command and family bytes followed by the address block.
+func proxyHeaderV2(command byte, family byte, block []byte) []byte {
+	header := append([]byte{}, proxySignature...)
+	header = append(header, command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(block)))
+	return append(header, block...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0x01, 0xBB}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xDC, 0x04, 0x01, 0xBB)
+	tests := []struct {
+		name   string
+		header []byte
+		remote string // empty if no address is provided
+		local  string
+		err    string // empty if the header is valid
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "192.0.2.1:56324", "192.0.2.2:443", ""},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443", ""},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", "", ""},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", "", ""},
+		{"v1 unsupported protocol", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "", "", "malformed v1 header"},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2 192.0.2.2 56324 443\r\n"), "", "", "malformed v1 header"},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n"), "", "", "malformed v1 header"},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1 192.0.2.2\r\n"), "", "", "malformed v1 header"},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 192.0"), "", "", "EOF"},
+		{"v1 oversized", []byte("PROXY TCP6 " + strings.Repeat("f", proxyHeaderLength) + "\r\n"), "", "", "v1 header too long"},
+		{"v2 PROXY TCP4", proxyHeaderV2(0x21, 0x11, ipv4), "192.0.2.1:56324", "192.0.2.2:443", ""},
+		{"v2 PROXY TCP6", proxyHeaderV2(0x21, 0x21, ipv6), "[2001:db8::1]:56324", "[2001:db8::2]:443", ""},
+		{"v2 PROXY with TLVs", proxyHeaderV2(0x21, 0x11, append(append([]byte{}, ipv4...), 0x01, 0x00, 0x02, 'h', '2')), "192.0.2.1:56324", "192.0.2.2:443", ""},
+		{"v2 LOCAL", proxyHeaderV2(0x20, 0x00, nil), "", "", ""},
+		{"v2 LOCAL with addresses", proxyHeaderV2(0x20, 0x11, ipv4), "", "", ""},
+		{"v2 UNSPEC", proxyHeaderV2(0x21, 0x00, nil), "", "", ""},
+		{"v2 unix addresses", proxyHeaderV2(0x21, 0x31, make([]byte, 216)), "", "", ""},
+		{"v2 unsupported version", proxyHeaderV2(0x11, 0x11, ipv4), "", "", "unsupported version 1"},
+		{"v2 unsupported command", proxyHeaderV2(0x22, 0x11, ipv4), "", "", "unsupported command 2"},
+		{"v2 short address block", proxyHeaderV2(0x21, 0x21, ipv4), "", "", "truncated v2 address block"},
+		{"v2 truncated address block", proxyHeaderV2(0x21, 0x11, ipv4)[:len(proxySignature)+4+6], "", "", "EOF"},
+		{"v2 truncated signature", proxySignature[:8], "", "", "EOF"},
+		{"missing signature", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", "", "missing signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bytes.NewReader(append(append([]byte{}, test.header...), "GET /"...))
+			remote, local, err := readProxyHeader(reader)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proxyTestAddress(remote) != test.remote || proxyTestAddress(local) != test.local {
+				t.Fatalf("addresses %s => %s instead of %s => %s", proxyTestAddress(remote), proxyTestAddress(local), test.remote, test.local)
+			}
+			// the request following the header must not be consumed
+			if rest, _ := io.ReadAll(reader); string(rest) != "GET /" {
+				t.Fatalf("read beyond the header, %q left", rest)
+			}
+		})
+	}
+}
+
+func proxyTestAddress(value net.Addr) string {
+	if value == nil {
+		return ""
+	}
+	return value.String()
+}
+
+func TestProxyConnReportsAddressesOfHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET /"))
+	connection := &proxyConn{Conn: server}
+	defer connection.Close()
+	if remote := connection.RemoteAddr().String(); remote != "192.0.2.1:56324" {
+		t.Fatal("unexpected remote address", remote)
+	}
+	if local := connection.LocalAddr().String(); local != "192.0.2.2:443" {
+		t.Fatal("unexpected local address", local)
+	}
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(connection, buffer); err != nil || string(buffer) != "GET /" {
+		t.Fatalf("unexpected payload %q (%v)", buffer, err)
+	}
+
+	// connections without a valid header fail on the first read
+	client, server = net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	connection = &proxyConn{Conn: server}
+	defer connection.Close()
+	if _, err := connection.Read(buffer); err == nil || !strings.Contains(err.Error(), "invalid PROXY protocol header") {
+		t.Fatal("connection without header accepted:", err)
+	}
+	if remote := connection.RemoteAddr(); remote != server.RemoteAddr() {
+		t.Fatal("unexpected remote address of a connection without header", remote)
+	}
+}
@@ -3,21 +3,24 @@ package mdath
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mdath/log"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	BuildVersion       int    = 31
-	UserAgent          string = "" // "Mozilla/5.0 (System; OS) MangaDex@Home/2.x.x (JSON) cheetah/31.0"
 	ApiServerURL       string = "https://api.mangadex.network"
 	DefaultUpstreamURL string = "https://uploads.mangadex.org"
 	MinCacheSize       int64  = 64_424_509_440        // 60 GB
 	DefaultCacheSize   int64  = 1_125_899_906_842_624 // 1 PB
 	KeepAliveInterval         = 1 * time.Minute
+	apiTimeout                = 30 * time.Second
 )
 
 type PingRequestPayload struct {
@@ -55,12 +58,29 @@ type StopRequestPayload struct {
 type StopResponsePayload struct {
 }
 
+type RemoteStatus struct {
+	ClientID           string    `json:"client_id"`
+	ClientURL          string    `json:"url"`
+	Paused             bool      `json:"paused"`
+	Compromised        bool      `json:"compromised"`
+	BuildVersion       int       `json:"build"`
+	LatestBuildVersion int       `json:"latest_build"`
+	UpstreamServer     string    `json:"upstream"`
+	LastPing           time.Time `json:"last_ping"`
+}
+
 type RemoteController struct {
 	connected        bool
 	config           PingRequestPayload
 	upstream         string
 	tlsProvider      *TLSProvider
 	requestValidator *RequestValidator
+	client           *UpstreamClient
+	status           RemoteStatus
+	stateFile        string
+	encryptState     bool
+	saved            *remoteState
+	mutex            sync.RWMutex
 }
 
 // Instantiate a new RemoteController for interacting with the MangaDex@Home Remote API server.
@@ -90,6 +110,11 @@ func CreateRemoteController(key string, ip string, port int, cache int64, speed
 		upstream:         DefaultUpstreamURL,
 		tlsProvider:      new(TLSProvider),
 		requestValidator: new(RequestValidator),
+		client:           CreateUpstreamClient(UpstreamClientOptions{Timeout: apiTimeout, Retries: RequestRetries}),
+		status: RemoteStatus{
+			BuildVersion:   BuildVersion,
+			UpstreamServer: DefaultUpstreamURL,
+		},
 	}
 	go func() {
 		for range time.Tick(KeepAliveInterval) {
@@ -104,7 +129,7 @@ func CreateRemoteController(key string, ip string, port int, cache int64, speed
 func (instance *RemoteController) ping() (err error) {
 	payload := instance.config
 	data := new(PingResponsePayload)
-	err = post("/ping", payload, data)
+	err = instance.post("/ping", payload, data)
 	if err != nil {
 		return
 	}
@@ -114,10 +139,28 @@ func (instance *RemoteController) ping() (err error) {
 		instance.tlsProvider.Update(data.TLS)
 	}
 	instance.requestValidator.Update(data.ExpirationTokenDisabled, data.ExpirationTokenDecryptionKey)
+	instance.saveState(remoteState{
+		Upstream:      data.UpstreamServer,
+		TokenKey:      data.ExpirationTokenDecryptionKey,
+		TokenDisabled: data.ExpirationTokenDisabled,
+		TLS:           instance.tlsProvider.currentInfo(),
+	})
+	instance.mutex.Lock()
+	instance.status = RemoteStatus{
+		ClientID:           data.ClientID,
+		ClientURL:          data.ClientURL,
+		Paused:             data.Paused,
+		Compromised:        data.Compromised,
+		BuildVersion:       BuildVersion,
+		LatestBuildVersion: data.LatestBuildVersion,
+		UpstreamServer:     data.UpstreamServer,
+		LastPing:           time.Now(),
+	}
+	instance.mutex.Unlock()
 	log.Info(strings.Join([]string{"PING MangaDex@Home Remote API Server",
 		fmt.Sprintf("  > Client:   id=%s, build=%d/%d, paused=%t, compromised=%t", data.ClientID, BuildVersion, data.LatestBuildVersion, data.Paused, data.Compromised),
 		fmt.Sprintf("  > Token:    verify=%t, key=%s", !data.ExpirationTokenDisabled, data.ExpirationTokenDecryptionKey),
-		fmt.Sprintf("  > TLS:      change=%t, created=%s", data.TLS != nil, instance.tlsProvider.info.CreationDate),
+		fmt.Sprintf("  > TLS:      change=%t, created=%s", data.TLS != nil, instance.tlsProvider.CreationDate()),
 		"  > Address:  " + data.ClientURL,
 		"  > Upstream: " + data.UpstreamServer,
 	}, "\n"))
@@ -129,20 +172,68 @@ func (instance *RemoteController) Connect() (upstreamServer *string, tlsProvider
 	if instance.connected {
 		return
 	}
+	upstreamServer = &instance.upstream
+	tlsProvider = instance.tlsProvider
+	requestValidator = instance.requestValidator
+	if instance.stateFile != "" {
+		state, stateErr := instance.loadState()
+		if stateErr == nil {
+			instance.restoreState(state)
+			instance.connected = true
+			log.Info("Restored client state of", state.Saved.Format(time.RFC3339), "connecting to MangaDex@Home Remote API Server in the background")
+			go func() {
+				if err := instance.ping(); err != nil {
+					log.Warn("Failed to connect to MangaDex@Home Remote API Server, serving the persisted certificate until the next ping", err)
+				}
+			}()
+			return
+		}
+		if !os.IsNotExist(stateErr) {
+			log.Warn("Ignoring persisted client state", stateErr)
+		}
+	}
 	instance.config.CertificateCreationDate = ""
 	err = instance.ping()
 	if err != nil {
 		log.Error("Failed to connected to MangaDex@Home Remote API Server", err)
-		return
+		return nil, nil, nil, err
 	}
-	upstreamServer = &instance.upstream
-	tlsProvider = instance.tlsProvider
-	requestValidator = instance.requestValidator
 	instance.connected = true
 	log.Info("Connected to MangaDex@Home Remote API Server")
 	return
 }
 
+// Apply the persisted client information as if it was received with a ping.
+func (instance *RemoteController) restoreState(state *remoteState) {
+	instance.upstream = state.Upstream
+	instance.config.CertificateCreationDate = state.TLS.CreationDate
+	instance.tlsProvider.Update(state.TLS)
+	instance.requestValidator.Update(state.TokenDisabled, state.TokenKey)
+	instance.saved = state
+	instance.mutex.Lock()
+	instance.status.UpstreamServer = state.Upstream
+	instance.mutex.Unlock()
+}
+
+// Provide the client information received with the latest successful ping.
+func (instance *RemoteController) Status() RemoteStatus {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.status
+}
+
+// Verify that the latest successful ping is not older than the given period.
+func (instance *RemoteController) CheckPing(period time.Duration) error {
+	last := instance.Status().LastPing
+	if last.IsZero() {
+		return errors.New("no successful ping yet")
+	}
+	if time.Since(last) > period {
+		return fmt.Errorf("last successful ping was %s ago", time.Since(last).Round(time.Second))
+	}
+	return nil
+}
+
 func (instance *RemoteController) Disconnect() (err error) {
 	if !instance.connected {
 		return
@@ -151,7 +242,7 @@ func (instance *RemoteController) Disconnect() (err error) {
 		ClientSecret: instance.config.ClientSecret,
 	}
 	data := new(StopResponsePayload)
-	err = post("/stop", payload, data)
+	err = instance.post("/stop", payload, data)
 	if err != nil {
 		log.Error("Failed to disconnect from MangaDex@Home Remote API Server", err)
 		return
@@ -161,7 +252,13 @@ func (instance *RemoteController) Disconnect() (err error) {
 	return
 }
 
-func post(endpoint string, payload interface{}, data interface{}) (err error) {
+// Use the given client options (e.g. an outbound proxy) for requests to the MangaDex@Home Remote API Server (pings are never retried, the next ping follows anyway).
+func (instance *RemoteController) UseClientOptions(options UpstreamClientOptions) {
+	options.Timeout = apiTimeout
+	instance.client = CreateUpstreamClient(options)
+}
+
+func (instance *RemoteController) post(endpoint string, payload interface{}, data interface{}) (err error) {
 	buffer := new(bytes.Buffer)
 	err = json.NewEncoder(buffer).Encode(payload)
 	if err != nil {
@@ -173,8 +270,7 @@ func post(endpoint string, payload interface{}, data interface{}) (err error) {
 		return
 	}
 	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("User-Agent", UserAgent)
-	response, err := http.DefaultClient.Do(request)
+	response, err := instance.client.Do(request)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,111 @@
+package mdath
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"mdath/log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Client information of the latest successful ping, which allows to serve images before the first ping of a restart completed.
+type remoteState struct {
+	Upstream      string    `json:"upstream"`
+	TokenKey      string    `json:"token_key"`
+	TokenDisabled bool      `json:"token_disabled"`
+	TLS           *TLSInfo  `json:"tls"`
+	Saved         time.Time `json:"saved"`
+}
+
+// Persist the client information (TLS bundle and token key) in the given file, optionally encrypted with the client secret.
+// A valid state lets Connect return immediately with the persisted certificate, while the ping completes in the background.
+func (instance *RemoteController) UseStateFile(path string, encrypt bool) {
+	instance.stateFile = path
+	instance.encryptState = encrypt
+}
+
+func (instance *RemoteController) stateKey() *[KeySize]byte {
+	key := sha256.Sum256([]byte("cheetah state\n" + instance.config.ClientSecret))
+	return &key
+}
+
+// Write the state if it differs from the persisted one (only readable by the owner).
+func (instance *RemoteController) saveState(state remoteState) {
+	if instance.stateFile == "" || state.TLS == nil {
+		return
+	}
+	if instance.saved != nil && instance.saved.Upstream == state.Upstream && instance.saved.TokenKey == state.TokenKey &&
+		instance.saved.TokenDisabled == state.TokenDisabled && *instance.saved.TLS == *state.TLS {
+		return
+	}
+	state.Saved = time.Now()
+	data, err := json.Marshal(state)
+	if err == nil && instance.encryptState {
+		var nonce [NonceSize]byte
+		if _, err = io.ReadFull(rand.Reader, nonce[:]); err == nil {
+			data = secretbox.Seal(nonce[:], data, &nonce, instance.stateKey())
+		}
+	}
+	temporary := instance.stateFile + ".tmp"
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(instance.stateFile), 0700)
+	}
+	if err == nil {
+		// remove a leftover, so the file is created with the permissions below
+		os.Remove(temporary)
+		err = os.WriteFile(temporary, data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(temporary, instance.stateFile)
+	}
+	if err != nil {
+		log.Warn("Failed to persist client state", err)
+		return
+	}
+	instance.saved = &state
+}
+
+// Read the persisted state (plain or encrypted), which is only usable with a certificate that is still valid.
+func (instance *RemoteController) loadState() (state *remoteState, err error) {
+	data, err := os.ReadFile(instance.stateFile)
+	if err != nil {
+		return
+	}
+	// encrypted files start with the nonce, plain files with the JSON object
+	if len(data) > NonceSize {
+		var nonce [NonceSize]byte
+		copy(nonce[:], data[:NonceSize])
+		if decrypted, ok := secretbox.Open(nil, data[NonceSize:], &nonce, instance.stateKey()); ok {
+			data = decrypted
+		} else if data[0] != '{' {
+			return nil, errors.New("decryption of state file failed (changed client secret?)")
+		}
+	}
+	state = new(remoteState)
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.TLS == nil {
+		return nil, errors.New("state file contains no certificate")
+	}
+	cert, err := tls.X509KeyPair([]byte(state.TLS.Certificate), []byte(state.TLS.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, errors.New("persisted certificate expired")
+	}
+	return
+}
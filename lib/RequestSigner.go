@@ -0,0 +1,73 @@
+package mdath
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// header carrying the timestamp and signature of requests between proxy and cache nodes
+	SignatureHeader string = "X-Cluster-Signature"
+	// max. difference between the timestamp of a signed request and the clock of the cache node
+	SignatureTolerance     = 1 * time.Minute
+	minSecretLength    int = 16
+)
+
+// Signs requests of the proxy node and verifies them on the cache nodes with a shared secret (HMAC-SHA256 of timestamp, method and path).
+type RequestSigner struct {
+	secret []byte
+}
+
+// Instantiate a new RequestSigner with the secret shared by all nodes of the cluster.
+func CreateRequestSigner(secret string) (*RequestSigner, error) {
+	if len(secret) < minSecretLength {
+		return nil, errors.New("the cluster secret must have at least 16 characters")
+	}
+	return &RequestSigner{secret: []byte(secret)}, nil
+}
+
+// Add the signature header to a request which is about to be sent to a cache node.
+func (instance *RequestSigner) Sign(request *http.Request) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(SignatureHeader, "t="+timestamp+",s="+instance.signature(timestamp, request.Method, request.URL.Path))
+}
+
+// Verify that a received request has been signed with the shared secret recently.
+func (instance *RequestSigner) Verify(request *http.Request) error {
+	header := request.Header.Get(SignatureHeader)
+	if header == "" {
+		return errors.New("missing cluster signature")
+	}
+	var timestamp, signature string
+	for _, field := range strings.Split(header, ",") {
+		switch {
+		case strings.HasPrefix(field, "t="):
+			timestamp = strings.TrimPrefix(field, "t=")
+		case strings.HasPrefix(field, "s="):
+			signature = strings.TrimPrefix(field, "s=")
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp of cluster signature")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return errors.New("cluster signature expired")
+	}
+	if !hmac.Equal([]byte(signature), []byte(instance.signature(timestamp, request.Method, request.URL.Path))) {
+		return errors.New("invalid cluster signature")
+	}
+	return nil
+}
+
+func (instance *RequestSigner) signature(timestamp string, method string, path string) string {
+	mac := hmac.New(sha256.New, instance.secret)
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
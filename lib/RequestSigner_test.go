@@ -0,0 +1,91 @@
+package mdath
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const signerTestSecret string = "0123456789abcdef0123"
+
+func TestCreateRequestSignerRequiresLongSecret(t *testing.T) {
+	if _, err := CreateRequestSigner("too short"); err == nil {
+		t.Fatal("short cluster secret accepted")
+	}
+}
+
+func TestRequestSignerVerify(t *testing.T) {
+	signer, err := CreateRequestSigner(signerTestSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := CreateRequestSigner(signerTestSecret + "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/token/data/0123456789abcdef0123456789abcdef/x1-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.png"
+	// header signed with the given signer at the given time
+	header := func(signer *RequestSigner, method string, path string, signed time.Time) string {
+		timestamp := strconv.FormatInt(signed.Unix(), 10)
+		return "t=" + timestamp + ",s=" + signer.signature(timestamp, method, path)
+	}
+	now := time.Now()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		err    string // empty if the request must be accepted
+	}{
+		{"valid", http.MethodGet, path, header(signer, http.MethodGet, path, now), ""},
+		{"fields in any order", http.MethodGet, path, strings.Join([]string{"s=" + signer.signature(strconv.FormatInt(now.Unix(), 10), http.MethodGet, path), "t=" + strconv.FormatInt(now.Unix(), 10)}, ","), ""},
+		{"within tolerance", http.MethodGet, path, header(signer, http.MethodGet, path, now.Add(-SignatureTolerance+5*time.Second)), ""},
+		{"missing header", http.MethodGet, path, "", "missing cluster signature"},
+		{"missing timestamp", http.MethodGet, path, "s=" + signer.signature("", http.MethodGet, path), "invalid timestamp"},
+		{"invalid timestamp", http.MethodGet, path, "t=yesterday,s=" + signer.signature("yesterday", http.MethodGet, path), "invalid timestamp"},
+		{"expired", http.MethodGet, path, header(signer, http.MethodGet, path, now.Add(-SignatureTolerance-5*time.Second)), "expired"},
+		{"future", http.MethodGet, path, header(signer, http.MethodGet, path, now.Add(SignatureTolerance+5*time.Second)), "expired"},
+		{"tampered path", http.MethodGet, path, header(signer, http.MethodGet, strings.Replace(path, "/data/", "/data-saver/", 1), now), "invalid cluster signature"},
+		{"tampered method", http.MethodGet, path, header(signer, http.MethodHead, path, now), "invalid cluster signature"},
+		{"tampered timestamp", http.MethodGet, path, "t=" + strconv.FormatInt(now.Unix()+1, 10) + ",s=" + signer.signature(strconv.FormatInt(now.Unix(), 10), http.MethodGet, path), "invalid cluster signature"},
+		{"missing signature", http.MethodGet, path, "t=" + strconv.FormatInt(now.Unix(), 10), "invalid cluster signature"},
+		{"other secret", http.MethodGet, path, header(other, http.MethodGet, path, now), "invalid cluster signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, path, nil)
+			if test.header != "" {
+				request.Header.Set(SignatureHeader, test.header)
+			}
+			err := signer.Verify(request)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal("valid signature rejected:", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestRequestSignerSignsForVerify(t *testing.T) {
+	signer, err := CreateRequestSigner(signerTestSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/token/data/0123456789abcdef0123456789abcdef/x1-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.png", nil)
+	signer.Sign(request)
+	if err = signer.Verify(request); err != nil {
+		t.Fatal("signed request rejected:", err)
+	}
+	request.URL.Path = strings.Replace(request.URL.Path, "/token/", "/other/", 1)
+	if signer.Verify(request) == nil {
+		t.Fatal("request with a tampered token accepted")
+	}
+}
@@ -28,6 +28,7 @@ type RequestValidator struct {
 	disabled  bool
 	keyBase64 string
 	keyBytes  [KeySize]byte
+	signer    *RequestSigner
 }
 
 func (instance *RequestValidator) Update(disabled bool, key string) (err error) {
@@ -44,12 +45,22 @@ func (instance *RequestValidator) Update(disabled bool, key string) (err error)
 	return
 }
 
+// Only accept requests which have been signed by a proxy node of the cluster (independent of the token validation).
+func (instance *RequestValidator) RequireSignature(signer *RequestSigner) {
+	instance.signer = signer
+}
+
 // Verify that the path and the token are valid and returns the path without the token.
 func (instance *RequestValidator) ExtractValidatedPath(request *http.Request) (path string, file string, err error) {
 	token, path, file, err := instance.verifyPath(request.URL.Path)
 	if err != nil {
 		return
 	}
+	if instance.signer != nil {
+		if err = instance.signer.Verify(request); err != nil {
+			return
+		}
+	}
 	err = instance.verifyReferer(request.Referer())
 	if err != nil {
 		return
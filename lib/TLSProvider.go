@@ -1,19 +1,45 @@
 package mdath
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"mdath/log"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
+// Default interval in which certificate files are checked for changes.
+const CertificateCheckInterval = 30 * time.Second
+
 type TLSProvider struct {
-	info  *TLSInfo
-	cert  *tls.Certificate
-	mutex sync.RWMutex
+	info      *TLSInfo
+	cert      *tls.Certificate
+	authority *x509.CertPool // CA which signs the certificates of the cluster (clients of the listener and servers of the client)
+	files     certificateFiles
+	local     bool // the certificate is loaded from files or self-signed and never replaced by the remote API
+	mutex     sync.RWMutex
+}
+
+// Certificate files loaded into the TLSProvider and their state (modification time and size) when they were loaded.
+type certificateFiles struct {
+	certificate    string
+	key            string
+	authority      string
+	certificateRev string
+	authorityRev   string
 }
 
-// Provide a HTTPS listener based on the underlying TLS configuration.
-func (instance *TLSProvider) CreateListener(network string, address string) (listener net.Listener, err error) {
+// Provide a HTTPS listener based on the underlying TLS configuration (optionally expecting a PROXY protocol header before the TLS handshake).
+func (instance *TLSProvider) CreateListener(network string, address string, proxyProtocol bool) (listener net.Listener, err error) {
 	config := &tls.Config{
 		ClientAuth: tls.NoClientCert,
 		//MinVersion:               tls.VersionTLS10,
@@ -60,10 +86,182 @@ func (instance *TLSProvider) CreateListener(network string, address string) (lis
 	if err != nil {
 		return
 	}
+	if proxyProtocol {
+		listener = &proxyListener{listener}
+	}
+	config.GetConfigForClient = instance.clientAuthentication(config)
 	listener = tls.NewListener(listener, config)
 	return
 }
 
+// Require client certificates signed by the authority once it is loaded (the authority can be replaced at any time).
+func (instance *TLSProvider) clientAuthentication(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		instance.mutex.RLock()
+		authority := instance.authority
+		instance.mutex.RUnlock()
+		if authority == nil {
+			return nil, nil
+		}
+		authenticated := config.Clone()
+		authenticated.GetConfigForClient = nil
+		authenticated.ClientAuth = tls.RequireAndVerifyClientCert
+		authenticated.ClientCAs = authority
+		return authenticated, nil
+	}
+}
+
+// Provide the TLS configuration for connections to the given server of the cluster (host name or IP address), which presents the loaded certificate as client certificate
+// and only accepts server certificates for that host signed by the loaded authority (or by the system roots if no authority is loaded).
+func (instance *TLSProvider) ClientConfig(host string) *tls.Config {
+	return &tls.Config{
+		ServerName:           host,
+		GetClientCertificate: instance.GetClientCertificate,
+		// the chain is verified by verifyServer, so a replaced authority applies to new connections
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return instance.verifyServer(host, state)
+		},
+	}
+}
+
+func (instance *TLSProvider) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	if instance.cert == nil {
+		// no client certificate
+		return &tls.Certificate{}, nil
+	}
+	return instance.cert, nil
+}
+
+// Verify the chain of the server certificate and that it's issued for the dialed host (IP addresses are matched against the IP SANs).
+func (instance *TLSProvider) verifyServer(host string, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no server certificate")
+	}
+	instance.mutex.RLock()
+	authority := instance.authority
+	instance.mutex.RUnlock()
+	options := x509.VerifyOptions{
+		Roots:         authority,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, intermediate := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(intermediate)
+	}
+	_, err := state.PeerCertificates[0].Verify(options)
+	return err
+}
+
+// Load the certificate (including intermediates) and private key from PEM files, which replaces certificates of the remote API.
+func (instance *TLSProvider) LoadCertificateFiles(certificate string, key string) error {
+	revision := fileRevision(certificate, key)
+	cert, err := tls.LoadX509KeyPair(certificate, key)
+	if err != nil {
+		return err
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.cert = &cert
+	instance.local = true
+	instance.files.certificate, instance.files.key, instance.files.certificateRev = certificate, key, revision
+	return nil
+}
+
+// Generate an ephemeral self-signed certificate for the given host names and IP addresses (e.g. for development), which is only kept in memory.
+func (instance *TLSProvider) GenerateCertificate(hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "cheetah self-signed"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.cert = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	instance.local = true
+	return nil
+}
+
+// Load the CA certificates (PEM) which sign the client certificates of the listener and the server certificates of the client.
+func (instance *TLSProvider) LoadAuthorityFile(authority string) error {
+	revision := fileRevision(authority)
+	data, err := os.ReadFile(authority)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no CA certificate found in %s", authority)
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.authority = pool
+	instance.files.authority, instance.files.authorityRev = authority, revision
+	return nil
+}
+
+// Check the loaded files for changes in the given interval and reload them (the previous files stay in use if a changed file is invalid).
+func (instance *TLSProvider) WatchFiles(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			instance.mutex.RLock()
+			files := instance.files
+			instance.mutex.RUnlock()
+			if files.certificate != "" && fileRevision(files.certificate, files.key) != files.certificateRev {
+				if err := instance.LoadCertificateFiles(files.certificate, files.key); err != nil {
+					log.Warn("Failed to reload certificate", err)
+				} else {
+					log.Info("Reloaded certificate", files.certificate)
+				}
+			}
+			if files.authority != "" && fileRevision(files.authority) != files.authorityRev {
+				if err := instance.LoadAuthorityFile(files.authority); err != nil {
+					log.Warn("Failed to reload CA certificates", err)
+				} else {
+					log.Info("Reloaded CA certificates", files.authority)
+				}
+			}
+		}
+	}()
+}
+
+// Identify the state of the files by their modification time and size.
+func fileRevision(paths ...string) (revision string) {
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			revision += fmt.Sprintf("%d/%d;", info.ModTime().UnixNano(), info.Size())
+		} else {
+			revision += "-;"
+		}
+	}
+	return
+}
+
 // Provide the certificate of the underlying TLS configuration used in the provided HTTPS listener.
 func (instance *TLSProvider) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	instance.mutex.RLock()
@@ -73,7 +271,11 @@ func (instance *TLSProvider) GetCertificate(clientHello *tls.ClientHelloInfo) (*
 
 // Update the certificate of the underlying TLS configuration used in the provided HTTPS listener.
 func (instance *TLSProvider) Update(info *TLSInfo) {
-	if instance.info != nil && instance.info.CreationDate == info.CreationDate {
+	instance.mutex.RLock()
+	unchanged := instance.info != nil && instance.info.CreationDate == info.CreationDate
+	local := instance.local
+	instance.mutex.RUnlock()
+	if unchanged || local {
 		return
 	}
 	cert, err := tls.X509KeyPair([]byte(info.Certificate), []byte(info.PrivateKey))
@@ -84,3 +286,29 @@ func (instance *TLSProvider) Update(info *TLSInfo) {
 		instance.cert = &cert
 	}
 }
+
+func (instance *TLSProvider) currentInfo() *TLSInfo {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	return instance.info
+}
+
+// Verify that a certificate is available for the provided HTTPS listener.
+func (instance *TLSProvider) CheckCertificate() error {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	if instance.cert == nil {
+		return errors.New("no certificate loaded")
+	}
+	return nil
+}
+
+// Provide the creation date of the currently used certificate (as reported by the MangaDex@Home Remote API server).
+func (instance *TLSProvider) CreationDate() string {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	if instance.info == nil {
+		return ""
+	}
+	return instance.info.CreationDate
+}
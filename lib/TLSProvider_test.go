@@ -0,0 +1,155 @@
+package mdath
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func createTestAuthority(t *testing.T) *testAuthority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthority{certificate, key}
+}
+
+func (instance *testAuthority) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(instance.certificate)
+	return pool
+}
+
+// Issue a server certificate for the given host names and IP addresses.
+func (instance *testAuthority) issue(t *testing.T, hosts ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, instance.certificate, &key.PublicKey, instance.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClusterClientVerifiesTheDialedHost(t *testing.T) {
+	authority := createTestAuthority(t)
+	foreign := createTestAuthority(t)
+	tests := []struct {
+		name     string
+		cert     tls.Certificate
+		accepted bool
+	}{
+		{"certificate for the IP address", authority.issue(t, "127.0.0.1"), true},
+		{"certificate for another IP address", authority.issue(t, "192.168.0.38"), false},
+		{"certificate for a host name", authority.issue(t, "cache.example.com"), false},
+		{"certificate of another CA", foreign.issue(t, "127.0.0.1"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {}))
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{test.cert}}
+			server.StartTLS()
+			defer server.Close()
+
+			provider := &TLSProvider{authority: authority.pool()}
+			client := CreateUpstreamClient(UpstreamClientOptions{TLS: provider, NoProxy: true})
+			response, err := client.Get(server.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+			if test.accepted && err != nil {
+				t.Fatal("valid certificate refused:", err)
+			}
+			if !test.accepted && err == nil {
+				t.Fatal("certificate accepted for", server.URL)
+			}
+		})
+	}
+}
+
+func TestConcurrentCertificateUpdates(t *testing.T) {
+	cert := createTestAuthority(t).issue(t, "127.0.0.1")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := TLSInfo{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})),
+	}
+	provider := new(TLSProvider)
+	var group sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		group.Add(2)
+		go func(i int) {
+			defer group.Done()
+			for j := 0; j < 50; j++ {
+				update := info
+				update.CreationDate = strconv.Itoa(i*100 + j)
+				provider.Update(&update)
+			}
+		}(i)
+		go func() {
+			defer group.Done()
+			for j := 0; j < 50; j++ {
+				provider.currentInfo()
+				provider.CreationDate()
+			}
+		}()
+	}
+	group.Wait()
+	if provider.CheckCertificate() != nil || provider.CreationDate() == "" {
+		t.Fatal("certificate not updated")
+	}
+}
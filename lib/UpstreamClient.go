@@ -0,0 +1,273 @@
+package mdath
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// default timeouts of the upstream client
+	DialTimeout           = 10 * time.Second
+	TLSHandshakeTimeout   = 10 * time.Second
+	ResponseHeaderTimeout = 30 * time.Second
+	RequestTimeout        = 5 * time.Minute // including the transfer of the body (which is limited by the speed of the downstream client)
+	// default max. number of idle connections kept per upstream host
+	MaxIdleConnsPerHost int = 64
+	// default number of additional attempts for idempotent requests which failed before a response was received
+	RequestRetries int = 2
+	retryBackoff       = 100 * time.Millisecond
+)
+
+// Sent with all requests to the upstream servers and the MangaDex@Home Remote API Server.
+var UserAgent = fmt.Sprintf("Mozilla/5.0 (%s; %s) MangaDex@Home/2.0.0 (JSON) cheetah/%d.0", runtime.GOOS, runtime.GOARCH, BuildVersion)
+
+type UpstreamClientOptions struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	Timeout               time.Duration // total time of a request including the body
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int // 0 for unlimited
+	DisableHTTP2          bool
+	Retries               int          // additional attempts for idempotent requests (0 for none)
+	Proxy                 *url.URL     // http://, https:// or socks5:// proxy (nil for the proxy configured by the environment, e.g. $HTTPS_PROXY)
+	NoProxy               bool         // ignore the proxy configured by the environment
+	SourceAddresses       []net.IP     // local addresses (at most one per IP version) used for outgoing connections
+	TLS                   *TLSProvider // client certificate and pinned CA for servers of the cluster (nil for the system roots)
+}
+
+// HTTP client for the upstream servers with timeouts, a connection pool per host and retries of idempotent requests.
+type UpstreamClient struct {
+	client  *http.Client
+	retries int
+}
+
+// Instantiate a new UpstreamClient, timeouts and limits which are not provided fall back to the defaults (requests are only retried with Retries > 0).
+func CreateUpstreamClient(options UpstreamClientOptions) *UpstreamClient {
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = DialTimeout
+	}
+	if options.TLSHandshakeTimeout <= 0 {
+		options.TLSHandshakeTimeout = TLSHandshakeTimeout
+	}
+	if options.ResponseHeaderTimeout <= 0 {
+		options.ResponseHeaderTimeout = ResponseHeaderTimeout
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = RequestTimeout
+	}
+	if options.MaxIdleConnsPerHost <= 0 {
+		options.MaxIdleConnsPerHost = MaxIdleConnsPerHost
+	}
+	if options.Retries < 0 {
+		options.Retries = 0
+	}
+	dialer := &net.Dialer{
+		Timeout:   options.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           sourceDialer(dialer, options.SourceAddresses),
+		TLSHandshakeTimeout:   options.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: options.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   options.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       options.MaxConnsPerHost,
+		ForceAttemptHTTP2:     !options.DisableHTTP2,
+	}
+	if options.Proxy != nil {
+		transport.Proxy = http.ProxyURL(options.Proxy)
+	} else if options.NoProxy {
+		transport.Proxy = nil
+	}
+	if options.DisableHTTP2 {
+		// a non-nil empty map prevents the upgrade to HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	var roundTripper http.RoundTripper = transport
+	if options.TLS != nil {
+		roundTripper = &clusterTransport{base: transport, provider: options.TLS, hosts: make(map[string]*http.Transport)}
+	}
+	return &UpstreamClient{
+		client: &http.Client{
+			Transport: roundTripper,
+			Timeout:   options.Timeout,
+		},
+		retries: options.Retries,
+	}
+}
+
+// Transport with a dedicated TLS configuration per server of the cluster, so each server certificate is verified against the dialed host.
+type clusterTransport struct {
+	base     *http.Transport
+	provider *TLSProvider
+	hosts    map[string]*http.Transport
+	mutex    sync.Mutex
+}
+
+func (instance *clusterTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Scheme != "https" {
+		return instance.base.RoundTrip(request)
+	}
+	host := request.URL.Hostname()
+	instance.mutex.Lock()
+	transport, ok := instance.hosts[host]
+	if !ok {
+		transport = instance.base.Clone()
+		transport.TLSClientConfig = instance.provider.ClientConfig(host)
+		instance.hosts[host] = transport
+	}
+	instance.mutex.Unlock()
+	return transport.RoundTrip(request)
+}
+
+func (instance *clusterTransport) CloseIdleConnections() {
+	instance.base.CloseIdleConnections()
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	for _, transport := range instance.hosts {
+		transport.CloseIdleConnections()
+	}
+}
+
+// Send the request with the user agent of this client.
+// Idempotent requests are retried when they fail before a response was received (responses with any status are never retried).
+func (instance *UpstreamClient) Do(request *http.Request) (response *http.Response, err error) {
+	request.Header.Set("User-Agent", UserAgent)
+	attempts := 1
+	if idempotent(request) {
+		attempts += instance.retries
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-request.Context().Done():
+				return nil, err
+			case <-time.After(time.Duration(attempt) * retryBackoff):
+			}
+			if request.GetBody != nil {
+				if request.Body, err = request.GetBody(); err != nil {
+					return
+				}
+			}
+		}
+		if response, err = instance.client.Do(request); err == nil {
+			return
+		}
+		if request.Context().Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+func (instance *UpstreamClient) Get(url string) (response *http.Response, err error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	return instance.Do(request)
+}
+
+func idempotent(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return request.Body == nil || request.Body == http.NoBody || request.GetBody != nil
+	default:
+		return false
+	}
+}
+
+// Parse the address of an outbound proxy, "direct" disables any proxy (nil without error means the proxy of the environment).
+func ParseProxy(value string) (proxy *url.URL, direct bool, err error) {
+	switch value {
+	case "":
+		return
+	case "direct":
+		direct = true
+		return
+	}
+	if proxy, err = url.Parse(value); err != nil {
+		return
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q (use http, https or socks5)", proxy.Scheme)
+	}
+	if err == nil && proxy.Host == "" {
+		err = errors.New("missing host of the proxy")
+	}
+	return
+}
+
+// Resolve the source address of outgoing connections, which is either an IP address or the name of a network interface.
+func ResolveSourceAddresses(value string) (addresses []net.IP, err error) {
+	if value == "" {
+		return
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	device, err := net.InterfaceByName(value)
+	if err != nil {
+		err = fmt.Errorf("neither an IP address nor a network interface: %s", value)
+		return
+	}
+	assigned, err := device.Addrs()
+	if err != nil {
+		return
+	}
+	var ipv4, ipv6 net.IP
+	for _, address := range assigned {
+		network, ok := address.(*net.IPNet)
+		if !ok || !network.IP.IsGlobalUnicast() {
+			continue
+		}
+		if network.IP.To4() != nil && ipv4 == nil {
+			ipv4 = network.IP
+		} else if network.IP.To4() == nil && ipv6 == nil {
+			ipv6 = network.IP
+		}
+	}
+	for _, ip := range []net.IP{ipv4, ipv6} {
+		if ip != nil {
+			addresses = append(addresses, ip)
+		}
+	}
+	if len(addresses) == 0 {
+		err = fmt.Errorf("network interface %s has no usable address", value)
+	}
+	return
+}
+
+// Dial from the given source addresses, restricted to the IP versions for which a source address is available (IPv4 is preferred).
+func sourceDialer(dialer *net.Dialer, sources []net.IP) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	if len(sources) == 0 {
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, network string, address string) (connection net.Conn, err error) {
+		for _, source := range sources {
+			bound := *dialer
+			bound.LocalAddr = &net.TCPAddr{IP: source}
+			version := "tcp6"
+			if source.To4() != nil {
+				version = "tcp4"
+			}
+			if connection, err = bound.DialContext(ctx, version, address); err == nil {
+				return
+			}
+		}
+		return
+	}
+}
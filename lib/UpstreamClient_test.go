@@ -0,0 +1,32 @@
+package mdath
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpstreamClientRetries(t *testing.T) {
+	var attempts int64
+	// drop each connection before a response was sent
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&attempts, 1)
+		connection, _, err := response.(http.Hijacker).Hijack()
+		if err == nil {
+			connection.Close()
+		}
+	}))
+	defer server.Close()
+
+	for _, retries := range []int{0, 2} {
+		atomic.StoreInt64(&attempts, 0)
+		client := CreateUpstreamClient(UpstreamClientOptions{Retries: retries})
+		if _, err := client.Get(server.URL); err == nil {
+			t.Fatal("dropped connection reported as response")
+		}
+		if count := atomic.LoadInt64(&attempts); count != int64(retries)+1 {
+			t.Fatal(count, "attempts with", retries, "retries")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// Serve the administrative endpoints for inspecting and purging a FileCacheHandler:
+//
+//	GET  /cache/lookup?image=HASH|PATH
+//	POST /cache/purge?image=HASH|PATH
+//	POST /cache/purge?chapter=HASH
+//	POST /cache/purge?prefix=HASH_PREFIX
+//	GET  /cache/usage
+type CacheAdminHandler struct {
+	cache *FileCacheHandler
+}
+
+func CreateCacheAdminHandler(cache *FileCacheHandler) (instance *CacheAdminHandler) {
+	return &CacheAdminHandler{
+		cache: cache,
+	}
+}
+
+func (instance *CacheAdminHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	var data interface{}
+	var err error
+	query := request.URL.Query()
+	switch endpoint := strings.TrimPrefix(request.URL.Path, "/cache/"); {
+	case endpoint == "lookup" && request.Method == http.MethodGet:
+		data, err = instance.cache.Lookup(query.Get("image"))
+	case endpoint == "purge" && request.Method == http.MethodPost:
+		if query.Get("image") != "" {
+			data, err = instance.cache.PurgeImage(query.Get("image"))
+		} else if query.Get("chapter") != "" {
+			data, err = instance.cache.PurgeChapter(query.Get("chapter"))
+		} else if query.Get("prefix") != "" {
+			data, err = instance.cache.PurgePrefix(query.Get("prefix"))
+		} else {
+			err = errors.New("missing one of the parameters: image, chapter, prefix")
+		}
+	case endpoint == "usage" && request.Method == http.MethodGet:
+		data, err = instance.cache.Usage()
+	default:
+		writeJSON(response, http.StatusNotFound, map[string]string{"error": "unknown endpoint or method"})
+		return
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		writeJSON(response, http.StatusNotFound, map[string]string{"error": "not found in cache"})
+	} else if err != nil {
+		writeJSON(response, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	} else {
+		writeJSON(response, http.StatusOK, data)
+	}
+}
+
+func writeJSON(response http.ResponseWriter, status int, data interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(status)
+	encoder := json.NewEncoder(response)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(data)
+}
@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"mdath/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// max. number of points on the hash ring for a single cache root (the root with the highest limit gets all of them)
+	maxRingPoints int = 256
+	// min. number of points on the hash ring for a single cache root
+	minRingPoints int = 16
+	// file (inside each cache root) containing the configuration of all roots, used for detecting changes
+	rootsManifest string = ".cheetah-roots"
+	// interval for re-checking cache roots which are offline
+	RootProbeInterval = 1 * time.Minute
+	// interval for re-measuring the usage of cache roots which are full
+	RootMeasureInterval = 15 * time.Minute
+)
+
+var errNoCacheRoot = errors.New("no cache root available")
+
+// A directory for storing cached images (e.g. the mount point of a dedicated disk) and the max. number of bytes it may use (math.MaxInt64 for no limit besides the disk).
+type CacheRoot struct {
+	Directory string
+	Limit     int64
+	Storage   CacheStorage // backend for the images (the cache layout inside Directory if not provided)
+}
+
+type CacheRootStatus struct {
+	Directory string `json:"directory"`
+	Tier      string `json:"tier"`
+	Limit     int64  `json:"limit"`
+	Used      int64  `json:"used"`
+	Full      bool   `json:"full"`
+	Offline   bool   `json:"offline"`
+}
+
+type cacheRoot struct {
+	CacheRoot
+	tier    *cacheRoots
+	used    int64
+	offline int32
+	full    int32 // the disk ran out of space (independent of the limit)
+}
+
+// The location of the image for reports (the actual location depends on the storage).
+func (instance *cacheRoot) location(key string) string {
+	return filepath.Join(instance.Directory, filepath.FromSlash(key))
+}
+
+// Whether the images are stored in the directory of the root (which can also hold the manifest of the roots and the chapters).
+func (instance *cacheRoot) local() bool {
+	switch instance.Storage.(type) {
+	case *DirectoryStorage, *SegmentStorage:
+		return true
+	}
+	return false
+}
+
+func (instance *cacheRoot) available() bool {
+	return atomic.LoadInt32(&instance.offline) == 0
+}
+
+func (instance *cacheRoot) writable() bool {
+	return instance.available() && !instance.exhausted()
+}
+
+func (instance *cacheRoot) exhausted() bool {
+	return atomic.LoadInt32(&instance.full) != 0 || instance.usage() >= instance.Limit
+}
+
+// The bytes occupied by the root (the size of the stored images unless the storage reports its own usage).
+func (instance *cacheRoot) usage() int64 {
+	if storage, ok := instance.Storage.(storageUsage); ok {
+		return storage.Usage()
+	}
+	return atomic.LoadInt64(&instance.used)
+}
+
+func (instance *cacheRoot) account(bytes int64) {
+	atomic.AddInt64(&instance.used, bytes)
+}
+
+type ringPoint struct {
+	hash uint64
+	root *cacheRoot
+}
+
+// Set of cache roots where each image is placed by consistent hashing (weighted by the limit of each root).
+// Each set forms a tier of the cache (e.g. fast SSDs or large HDDs).
+type cacheRoots struct {
+	tier     string
+	roots    []*cacheRoot
+	ring     []ringPoint
+	hits     int64
+	promoted int64
+	demoted  int64
+}
+
+func createCacheRoots(configs []CacheRoot, tier string) (instance *cacheRoots) {
+	instance = &cacheRoots{tier: tier}
+	var highest int64 = 1
+	for _, config := range configs {
+		if config.Limit > highest {
+			highest = config.Limit
+		}
+	}
+	for _, config := range configs {
+		if config.Storage == nil {
+			config.Storage = CreateDirectoryStorage(config.Directory)
+		}
+		root := &cacheRoot{CacheRoot: config, tier: instance}
+		instance.roots = append(instance.roots, root)
+		points := int(float64(maxRingPoints) * float64(config.Limit) / float64(highest))
+		if points < minRingPoints {
+			points = minRingPoints
+		}
+		for i := 0; i < points; i++ {
+			instance.ring = append(instance.ring, ringPoint{hashKey(config.Directory + "#" + strconv.Itoa(i)), root})
+		}
+	}
+	sort.Slice(instance.ring, func(i, j int) bool {
+		return instance.ring[i].hash < instance.ring[j].hash
+	})
+	return
+}
+
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
+
+// Relative location of an image (hash + extension) in the cache layout, which is also used as key for the placement.
+func layoutKey(file string) string {
+	return file[0:2] + "/" + file[2:4] + "/" + file[56:]
+}
+
+// Walk the hash ring clockwise starting at the position of the image and invoke the callback for each distinct root until it returns true.
+func (instance *cacheRoots) walk(key string, callback func(root *cacheRoot) bool) {
+	hash := hashKey(key)
+	start := sort.Search(len(instance.ring), func(i int) bool {
+		return instance.ring[i].hash >= hash
+	})
+	visited := make(map[*cacheRoot]bool, len(instance.roots))
+	for i := 0; i < len(instance.ring) && len(visited) < len(instance.roots); i++ {
+		root := instance.ring[(start+i)%len(instance.ring)].root
+		if visited[root] {
+			continue
+		}
+		visited[root] = true
+		if callback(root) {
+			return
+		}
+	}
+}
+
+// The root which is responsible for the image when all roots are available.
+func (instance *cacheRoots) owner(key string) (owner *cacheRoot) {
+	instance.walk(key, func(root *cacheRoot) bool {
+		owner = root
+		return true
+	})
+	return
+}
+
+// The root where a new image shall be stored (skipping roots which are offline or full).
+func (instance *cacheRoots) place(key string) (target *cacheRoot) {
+	instance.walk(key, func(root *cacheRoot) bool {
+		if root.writable() {
+			target = root
+		}
+		return target != nil
+	})
+	return
+}
+
+// Find the root of a cached image, starting with the responsible root followed by all other available roots (e.g. previous placements).
+func (instance *cacheRoots) find(file string) (owner *cacheRoot, info StorageInfo, err error) {
+	key := layoutKey(file)
+	err = fs.ErrNotExist
+	instance.walk(key, func(root *cacheRoot) bool {
+		if !root.available() {
+			return false
+		}
+		info, err = root.Storage.Stat(key)
+		if err == nil {
+			owner = root
+			return true
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			instance.failed(root, err)
+			err = fs.ErrNotExist
+		}
+		return false
+	})
+	return
+}
+
+// The first root on the local file system, which also keeps track of the cached chapters (nil if there is none).
+func (instance *cacheRoots) primary() *cacheRoot {
+	for _, root := range instance.roots {
+		if root.local() {
+			return root
+		}
+	}
+	return nil
+}
+
+// Take the root out of service after an I/O error, a full disk only stops the placement of new images.
+func (instance *cacheRoots) failed(root *cacheRoot, err error) {
+	if root == nil {
+		return
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		if atomic.CompareAndSwapInt32(&root.full, 0, 1) {
+			log.Warn("Cache root is full, new images will be stored in other roots", root.Directory)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&root.offline, 0, 1) {
+		log.Error("Cache root is offline, images will be redistributed to other roots", root.Directory, err)
+	}
+}
+
+func (instance *cacheRoots) status() (status []CacheRootStatus) {
+	for _, root := range instance.roots {
+		used := root.usage()
+		status = append(status, CacheRootStatus{
+			Directory: root.Directory,
+			Tier:      instance.tier,
+			Limit:     root.Limit,
+			Used:      used,
+			Full:      root.exhausted(),
+			Offline:   !root.available(),
+		})
+	}
+	return
+}
+
+// Determine the used space of all roots in the background, re-check offline roots periodically and move misplaced images when the set of roots has changed.
+func (instance *cacheRoots) start() {
+	go func() {
+		manifest := instance.manifest()
+		changed := false
+		for _, root := range instance.roots {
+			var used int64
+			err := root.Storage.Walk("", func(key string, info StorageInfo) error {
+				used += info.Size
+				return nil
+			})
+			if err != nil {
+				instance.failed(root, err)
+				continue
+			}
+			// images stored during the scan were accounted already (the usage is an approximation anyway)
+			root.account(used)
+			if !root.local() {
+				continue
+			}
+			previous, _ := os.ReadFile(filepath.Join(root.Directory, rootsManifest))
+			if string(previous) != manifest && (len(previous) > 0 || used > 0) {
+				changed = true
+			}
+		}
+		if changed && len(instance.roots) > 1 {
+			instance.rebalance()
+		} else {
+			instance.writeManifest()
+		}
+	}()
+	go func() {
+		for range time.Tick(RootProbeInterval) {
+			instance.probe()
+		}
+	}()
+	go func() {
+		for range time.Tick(RootMeasureInterval) {
+			instance.measure()
+		}
+	}()
+}
+
+func (instance *cacheRoots) manifest() string {
+	lines := make([]string, 0, len(instance.roots))
+	for _, root := range instance.roots {
+		lines = append(lines, root.Directory+" "+strconv.FormatInt(root.Limit, 10))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (instance *cacheRoots) writeManifest() {
+	manifest := []byte(instance.manifest())
+	for _, root := range instance.roots {
+		if root.available() && root.local() {
+			os.WriteFile(filepath.Join(root.Directory, rootsManifest), manifest, 0644)
+		}
+	}
+}
+
+// Bring offline roots back into service once they are writable again.
+func (instance *cacheRoots) probe() {
+	for _, root := range instance.roots {
+		if root.available() {
+			continue
+		}
+		if probeStorage(root.Storage) != nil {
+			continue
+		}
+		atomic.StoreInt32(&root.offline, 0)
+		log.Info("Cache root is online again", root.Directory)
+	}
+}
+
+// Determine the usage of full roots again, so they receive new images once space was freed (e.g. by purging images or deleting other files).
+func (instance *cacheRoots) measure() {
+	for _, root := range instance.roots {
+		if !root.available() || !root.exhausted() {
+			continue
+		}
+		var used int64
+		err := root.Storage.Walk("", func(key string, info StorageInfo) error {
+			used += info.Size
+			return nil
+		})
+		if err != nil {
+			instance.failed(root, err)
+			continue
+		}
+		atomic.StoreInt64(&root.used, used)
+		if atomic.LoadInt32(&root.full) != 0 && probeStorage(root.Storage) == nil {
+			atomic.StoreInt32(&root.full, 0)
+		}
+		if !root.exhausted() {
+			log.Info("Cache root has free space again", root.Directory)
+		}
+	}
+}
+
+// Move all images which are not stored in their responsible root (e.g. after a root was added).
+func (instance *cacheRoots) rebalance() {
+	log.Info("Started rebalancing of the cache roots")
+	var moved, failed int64
+	for _, root := range instance.roots {
+		if !root.available() {
+			continue
+		}
+		root.Storage.Walk("", func(key string, info StorageInfo) error {
+			owner := instance.owner(key)
+			if owner == root || !owner.writable() {
+				return nil
+			}
+			if err := transferCacheImage(root.Storage, owner.Storage, key); err != nil {
+				failed++
+				log.Warn("Failed to move image to its cache root", root.location(key), err)
+				return nil
+			}
+			root.account(-info.Size)
+			owner.account(info.Size)
+			moved++
+			return nil
+		})
+	}
+	instance.writeManifest()
+	log.Info("Finished rebalancing of the cache roots:", moved, "images moved,", failed, "failed")
+}
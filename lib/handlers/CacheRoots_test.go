@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"math"
+	"syscall"
+	"testing"
+)
+
+func TestFullRootBecomesWritableAgain(t *testing.T) {
+	storage := CreateMemoryStorage()
+	roots := createCacheRoots([]CacheRoot{{Directory: "memory", Limit: 10, Storage: storage}}, HotTier)
+	root := roots.roots[0]
+
+	writer, err := storage.Put("ab/cd/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("0123456789"))
+	if err = writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	root.account(10)
+	if roots.place("ab/cd/other.png") != nil {
+		t.Fatal("image placed in a root which reached its limit")
+	}
+
+	if err = storage.Delete("ab/cd/image.png"); err != nil {
+		t.Fatal(err)
+	}
+	roots.measure()
+	if roots.place("ab/cd/other.png") != root {
+		t.Fatal("root not writable again after its images were deleted")
+	}
+}
+
+func TestDiskFullRootBecomesWritableAgain(t *testing.T) {
+	roots := createCacheRoots([]CacheRoot{{Directory: "memory", Limit: math.MaxInt64, Storage: CreateMemoryStorage()}}, HotTier)
+	root := roots.roots[0]
+
+	roots.failed(root, syscall.ENOSPC)
+	if !root.available() {
+		t.Fatal("full root taken out of service")
+	}
+	if roots.place("ab/cd/image.png") != nil {
+		t.Fatal("image placed in a full root")
+	}
+	roots.measure()
+	if roots.place("ab/cd/image.png") != root {
+		t.Fatal("root not writable again after space was freed")
+	}
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// default max. number of idle descriptors kept open per directory storage
+const OpenFiles int = 1024
+
+// Size and modification time of a stored image.
+type StorageInfo struct {
+	Size     int64
+	Modified time.Time
+}
+
+// Writer for a new image, which only becomes visible once it is committed.
+type StorageWriter interface {
+	io.Writer
+	// Make the written image available (replacing any previous image with the same key).
+	Commit() error
+	// Discard the written data (has no effect after Commit).
+	Abort()
+}
+
+// Backend for storing the images of a cache root.
+// Images are addressed by their layout key (e.g. ab/cd/12345678.png), missing images are reported with fs.ErrNotExist.
+type CacheStorage interface {
+	Get(key string) (reader io.ReadCloser, info StorageInfo, err error)
+	Put(key string) (writer StorageWriter, err error)
+	Stat(key string) (info StorageInfo, err error)
+	Delete(key string) error
+	// Invoke the callback for each stored image whose key starts with the given prefix (an empty prefix matches all images).
+	Walk(prefix string, callback func(key string, info StorageInfo) error) error
+}
+
+// Storage of images as files in a directory tree (the default cache layout).
+type DirectoryStorage struct {
+	directory   string
+	descriptors *descriptorCache
+}
+
+func CreateDirectoryStorage(directory string) *DirectoryStorage {
+	return &DirectoryStorage{directory: directory}
+}
+
+// Keep up to capacity descriptors of recently served images open, so hot images don't have to be opened for each request.
+func (instance *DirectoryStorage) CacheDescriptors(capacity int) {
+	if capacity > 0 {
+		instance.descriptors = createDescriptorCache(capacity)
+	}
+}
+
+// The location of the image on the file system (e.g. for serving or linking it without copying).
+func (instance *DirectoryStorage) Location(key string) string {
+	return filepath.Join(instance.directory, filepath.FromSlash(key))
+}
+
+// Provide the image as *cachedFile, so it can be sent with sendfile.
+func (instance *DirectoryStorage) Get(key string) (reader io.ReadCloser, info StorageInfo, err error) {
+	if instance.descriptors != nil {
+		if cached := instance.descriptors.acquire(key); cached != nil {
+			return cached, cached.info, nil
+		}
+	}
+	file, err := os.Open(instance.Location(key))
+	if err != nil {
+		return
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return
+	}
+	info = StorageInfo{stat.Size(), stat.ModTime()}
+	if instance.descriptors != nil {
+		return instance.descriptors.wrap(key, file, info), info, nil
+	}
+	return &cachedFile{File: file, info: info}, info, nil
+}
+
+func (instance *DirectoryStorage) Put(key string) (writer StorageWriter, err error) {
+	location := instance.Location(key)
+	if err = os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return
+	}
+	// the image is written into a temporary file first, so incomplete images are never served
+	file, err := os.CreateTemp(filepath.Dir(location), ".fill-*")
+	if err != nil {
+		return
+	}
+	return &directoryWriter{file, location, key, instance}, nil
+}
+
+func (instance *DirectoryStorage) Stat(key string) (info StorageInfo, err error) {
+	stat, err := os.Stat(instance.Location(key))
+	if err != nil {
+		return
+	}
+	return StorageInfo{stat.Size(), stat.ModTime()}, nil
+}
+
+func (instance *DirectoryStorage) Delete(key string) error {
+	instance.invalidate(key)
+	return os.Remove(instance.Location(key))
+}
+
+// Close the cached descriptors of an image which is replaced or removed.
+func (instance *DirectoryStorage) invalidate(key string) {
+	if instance.descriptors != nil {
+		instance.descriptors.remove(key)
+	}
+}
+
+func (instance *DirectoryStorage) Walk(prefix string, callback func(key string, info StorageInfo) error) error {
+	return filepath.WalkDir(instance.directory, func(location string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// the directory of a new cache is only created with the first image
+			if location == instance.directory && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if location == instance.directory {
+			return nil
+		}
+		relative, err := filepath.Rel(instance.directory, location)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(relative)
+		if entry.IsDir() {
+			// only descend into the two levels of the layout which may contain matching images
+			directory := key + "/"
+			if len(entry.Name()) != 2 || strings.Count(key, "/") > 1 || !(strings.HasPrefix(directory, prefix) || strings.HasPrefix(prefix, directory)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") || strings.Count(key, "/") != 2 || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		return callback(key, StorageInfo{stat.Size(), stat.ModTime()})
+	})
+}
+
+type directoryWriter struct {
+	*os.File
+	destination string
+	key         string
+	storage     *DirectoryStorage
+}
+
+func (instance *directoryWriter) Commit() (err error) {
+	err = instance.File.Close()
+	if err == nil {
+		err = os.Rename(instance.File.Name(), instance.destination)
+	}
+	if err == nil {
+		instance.storage.invalidate(instance.key)
+	}
+	if err != nil {
+		os.Remove(instance.File.Name())
+	}
+	return
+}
+
+func (instance *directoryWriter) Abort() {
+	if instance.File.Close() == nil {
+		os.Remove(instance.File.Name())
+	}
+}
+
+// Optional interface of storages which can verify their availability without storing an image.
+type storageChecker interface {
+	Check() error
+}
+
+// Optional interface of storages whose disk usage differs from the size of the stored images (e.g. space of deleted images which is reclaimed later).
+type storageUsage interface {
+	Usage() int64
+}
+
+// Check that new images can be stored (without leaving anything behind).
+func probeStorage(storage CacheStorage) error {
+	if checker, ok := storage.(storageChecker); ok {
+		return checker.Check()
+	}
+	writer, err := storage.Put(".probe")
+	if err != nil {
+		return err
+	}
+	writer.Abort()
+	return nil
+}
+
+// Copy an image from one storage to another and remove it from the source afterwards.
+func transferCacheImage(source CacheStorage, destination CacheStorage, key string) (err error) {
+	reader, _, err := source.Get(key)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	if err = storeCacheImage(destination, key, reader); err != nil {
+		return
+	}
+	return source.Delete(key)
+}
+
+// Store the content of the reader as image.
+func storeCacheImage(storage CacheStorage, key string, reader io.Reader) (err error) {
+	writer, err := storage.Put(key)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(writer, reader); err != nil {
+		writer.Abort()
+		return
+	}
+	return writer.Commit()
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// Behaviour which every CacheStorage has to provide (the handlers rely on it regardless of the backend).
+func TestCacheStorageContract(t *testing.T) {
+	storages := []struct {
+		name   string
+		create func(t *testing.T) CacheStorage
+	}{
+		{"directory", func(t *testing.T) CacheStorage {
+			return CreateDirectoryStorage(t.TempDir())
+		}},
+		{"directory with descriptors", func(t *testing.T) CacheStorage {
+			storage := CreateDirectoryStorage(t.TempDir())
+			storage.CacheDescriptors(OpenFiles)
+			return storage
+		}},
+		{"memory", func(t *testing.T) CacheStorage {
+			return CreateMemoryStorage()
+		}},
+		{"segment", func(t *testing.T) CacheStorage {
+			storage, err := CreateSegmentStorage(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return storage
+		}},
+	}
+	for _, backend := range storages {
+		t.Run(backend.name, func(t *testing.T) {
+			storage := backend.create(t)
+			key := "ab/cd/12345678.png"
+
+			if _, _, err := storage.Get(key); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal("Get of a missing image:", err)
+			}
+			if _, err := storage.Stat(key); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal("Stat of a missing image:", err)
+			}
+			if err := storage.Delete(key); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal("Delete of a missing image:", err)
+			}
+
+			// aborted images are never visible
+			writer, err := storage.Put(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.Write([]byte("aborted"))
+			writer.Abort()
+			if _, err = storage.Stat(key); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal("aborted image is visible:", err)
+			}
+
+			// images only become visible once committed
+			writer, err = storage.Put(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.Write([]byte("first "))
+			writer.Write([]byte("image"))
+			if _, err = storage.Stat(key); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal("uncommitted image is visible:", err)
+			}
+			if err = writer.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			writer.Abort()
+			checkStoredImage(t, storage, key, "first image")
+
+			// a new commit replaces the image
+			if err = storeCacheImage(storage, key, strings.NewReader("second")); err != nil {
+				t.Fatal(err)
+			}
+			checkStoredImage(t, storage, key, "second")
+
+			if err = storeCacheImage(storage, "ab/ef/87654321.jpg", strings.NewReader("other")); err != nil {
+				t.Fatal(err)
+			}
+			if err = storeCacheImage(storage, "cd/ef/11111111.png", strings.NewReader("elsewhere")); err != nil {
+				t.Fatal(err)
+			}
+			walked := make(map[string]int64)
+			err = storage.Walk("ab/", func(key string, info StorageInfo) error {
+				walked[key] = info.Size
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(walked) != 2 || walked[key] != 6 || walked["ab/ef/87654321.jpg"] != 5 {
+				t.Fatal("Walk of prefix ab/ returned", walked)
+			}
+			count := 0
+			stop := errors.New("stop")
+			if err = storage.Walk("", func(key string, info StorageInfo) error {
+				count++
+				return stop
+			}); err != stop || count != 1 {
+				t.Fatal("Walk didn't stop at the error of the callback:", count, err)
+			}
+
+			if err = storage.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err = storage.Get(key); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal("deleted image is still served:", err)
+			}
+			if _, err = storage.Stat("cd/ef/11111111.png"); err != nil {
+				t.Fatal("Delete removed another image:", err)
+			}
+		})
+	}
+}
+
+func checkStoredImage(t *testing.T, storage CacheStorage, key string, expected string) {
+	t.Helper()
+	reader, info, err := storage.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != expected || info.Size != int64(len(expected)) {
+		t.Fatalf("stored image is %q (%d bytes, %v) instead of %q", data, info.Size, err, expected)
+	}
+	if info, err = storage.Stat(key); err != nil || info.Size != int64(len(expected)) || info.Modified.IsZero() {
+		t.Fatal("unexpected Stat of the stored image:", info, err)
+	}
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"mdath/log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HotTier  string = "hot"
+	ColdTier string = "cold"
+
+	// default number of hits within the promotion window which bring an image of the cold tier back into the hot tier
+	PromoteHits int64 = 2
+	// default window in which the hits of an image of the cold tier are counted for its promotion
+	PromoteWindow = 1 * time.Hour
+	// default interval for checking whether images of the hot tier have to be demoted
+	DemoteInterval = 1 * time.Minute
+
+	// demotion starts when a root of the hot tier is filled above the high watermark and stops below the low watermark
+	demoteHighWatermark float64 = 0.95
+	demoteLowWatermark  float64 = 0.85
+	// granularity of the last access times for selecting images to be demoted
+	demoteBucket = 1 * time.Hour
+	// max. number of pending promotions (further promotions are dropped until the queue is drained)
+	promoteQueue int = 1024
+)
+
+type TierOptions struct {
+	PromoteHits    int64
+	PromoteWindow  time.Duration
+	DemoteInterval time.Duration
+}
+
+type CacheTierStatistics struct {
+	Tier     string `json:"tier"`
+	Hits     int64  `json:"hits"`
+	Limit    int64  `json:"limit"`
+	Used     int64  `json:"used"`
+	Promoted int64  `json:"promoted"` // images moved into the tier because they became hot again
+	Demoted  int64  `json:"demoted"`  // images moved into the tier because they became cold
+}
+
+type promotion struct {
+	key  string
+	root *cacheRoot
+}
+
+// Add a tier of large but slow roots (e.g. HDDs) behind the regular roots (e.g. SSDs).
+// New images are stored in the hot tier, the least recently used images are demoted to the cold tier instead of filling up the hot tier.
+// Images of the cold tier which are requested frequently again are promoted back into the hot tier.
+func (instance *FileCacheHandler) EnableColdTier(roots []CacheRoot, options TierOptions) {
+	if len(roots) == 0 {
+		return
+	}
+	if options.PromoteHits <= 0 {
+		options.PromoteHits = PromoteHits
+	}
+	if options.PromoteWindow <= 0 {
+		options.PromoteWindow = PromoteWindow
+	}
+	if options.DemoteInterval <= 0 {
+		options.DemoteInterval = DemoteInterval
+	}
+	instance.cold = createCacheRoots(roots, ColdTier)
+	instance.tiers = options
+	instance.promotions = make(chan promotion, promoteQueue)
+}
+
+// All tiers of the cache, starting with the hot tier.
+func (instance *FileCacheHandler) allTiers() []*cacheRoots {
+	if instance.cold == nil {
+		return []*cacheRoots{instance.roots}
+	}
+	return []*cacheRoots{instance.roots, instance.cold}
+}
+
+// All roots of all tiers.
+func (instance *FileCacheHandler) allRoots() (roots []*cacheRoot) {
+	for _, tier := range instance.allTiers() {
+		roots = append(roots, tier.roots...)
+	}
+	return
+}
+
+// Find the root of a cached image in any tier.
+func (instance *FileCacheHandler) find(file string) (root *cacheRoot, info StorageInfo, err error) {
+	for _, tier := range instance.allTiers() {
+		if root, info, err = tier.find(file); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// The root where a new image shall be stored, the cold tier is only used when the hot tier is full.
+// Reports when caching stops because all roots are full or offline (and when it resumes).
+func (instance *FileCacheHandler) place(key string) (target *cacheRoot) {
+	for _, tier := range instance.allTiers() {
+		if target = tier.place(key); target != nil {
+			if atomic.CompareAndSwapInt32(&instance.exhausted, 1, 0) {
+				log.Info("Caching new images again")
+			}
+			return
+		}
+	}
+	if atomic.CompareAndSwapInt32(&instance.exhausted, 0, 1) {
+		log.Warn("All cache roots are full or offline, new images are served without caching them")
+	}
+	return
+}
+
+// The root which keeps track of the cached chapters.
+func (instance *FileCacheHandler) primary() (root *cacheRoot) {
+	for _, tier := range instance.allTiers() {
+		if root = tier.primary(); root != nil {
+			return
+		}
+	}
+	return
+}
+
+func (instance *FileCacheHandler) tierStatistics() (statistics []CacheTierStatistics) {
+	for _, tier := range instance.allTiers() {
+		tierStatistics := CacheTierStatistics{
+			Tier:     tier.tier,
+			Hits:     atomic.LoadInt64(&tier.hits),
+			Promoted: atomic.LoadInt64(&tier.promoted),
+			Demoted:  atomic.LoadInt64(&tier.demoted),
+		}
+		for _, root := range tier.roots {
+			tierStatistics.Used += root.usage()
+			if tierStatistics.Limit > math.MaxInt64-root.Limit {
+				tierStatistics.Limit = math.MaxInt64
+			} else {
+				tierStatistics.Limit += root.Limit
+			}
+		}
+		statistics = append(statistics, tierStatistics)
+	}
+	return
+}
+
+// Count the hit for the tier of the root and schedule the promotion of images of the cold tier which became hot again.
+func (instance *FileCacheHandler) recordTierHit(key string, root *cacheRoot, previous ImageHits) {
+	atomic.AddInt64(&root.tier.hits, 1)
+	if root.tier != instance.cold || previous.Count+1 < instance.tiers.PromoteHits || time.Since(previous.LastHit) > instance.tiers.PromoteWindow {
+		return
+	}
+	select {
+	case instance.promotions <- promotion{key, root}:
+	default:
+	}
+}
+
+// Start the background demotion of cold images and the promotion of hot images (if a cold tier is enabled).
+func (instance *FileCacheHandler) startTiering() {
+	if instance.cold == nil {
+		return
+	}
+	go func() {
+		for promotion := range instance.promotions {
+			instance.promote(promotion.key, promotion.root)
+		}
+	}()
+	go func() {
+		for range time.Tick(instance.tiers.DemoteInterval) {
+			for _, root := range instance.roots.roots {
+				if excess := demotionExcess(root); excess > 0 && root.available() {
+					instance.demote(root, excess)
+				}
+			}
+		}
+	}()
+}
+
+func (instance *FileCacheHandler) promote(key string, source *cacheRoot) {
+	target := instance.roots.place(key)
+	if target == nil {
+		return
+	}
+	info, err := source.Storage.Stat(key)
+	if err != nil {
+		return
+	}
+	if err = transferCacheImage(source.Storage, target.Storage, key); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("Failed to promote image", source.location(key), err)
+		}
+		return
+	}
+	source.account(-info.Size)
+	target.account(info.Size)
+	atomic.AddInt64(&instance.roots.promoted, 1)
+	log.Verbose("Promoted image", source.location(key), "=>", target.location(key))
+}
+
+// The number of bytes to be demoted from the root, which is filled above the high watermark of its limit or whose disk ran full (zero otherwise).
+// The current usage of a full disk is taken as its capacity, so roots without limit are demoted as well.
+// Only the stored images count towards the excess, the space of deleted images is reclaimed by the storage itself (e.g. by compaction).
+func demotionExcess(root *cacheRoot) int64 {
+	usage := root.usage()
+	capacity := root.Limit
+	if atomic.LoadInt32(&root.full) != 0 {
+		if usage < capacity {
+			capacity = usage
+		}
+	} else if float64(usage) <= demoteHighWatermark*float64(capacity) {
+		return 0
+	}
+	return atomic.LoadInt64(&root.used) - int64(demoteLowWatermark*float64(capacity))
+}
+
+// The time of the last access of an image (the time it was stored if it wasn't requested since the start).
+func (instance *FileCacheHandler) lastAccess(key string, info StorageInfo) time.Time {
+	if hits := instance.hits.get(key); hits.LastHit.After(info.Modified) {
+		return hits.LastHit
+	}
+	return info.Modified
+}
+
+// Move the least recently used images of the root into the cold tier until excess bytes were freed.
+// The images are selected in two passes by a histogram of their last access times, so the memory usage doesn't depend on the number of images.
+func (instance *FileCacheHandler) demote(root *cacheRoot, excess int64) {
+	now := time.Now()
+	histogram := make(map[int64]int64)
+	var oldest int64
+	err := root.Storage.Walk("", func(key string, info StorageInfo) error {
+		age := int64(now.Sub(instance.lastAccess(key, info)) / demoteBucket)
+		histogram[age] += info.Size
+		if age > oldest {
+			oldest = age
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn("Failed to select images for demotion", root.Directory, err)
+		return
+	}
+	cutoff, selected := oldest, int64(0)
+	for ; cutoff >= 0 && selected < excess; cutoff-- {
+		selected += histogram[cutoff]
+	}
+	cutoff++
+
+	started := time.Now()
+	var demoted, freed int64
+	root.Storage.Walk("", func(key string, info StorageInfo) error {
+		if freed >= excess {
+			return errStopWalk
+		}
+		if int64(now.Sub(instance.lastAccess(key, info))/demoteBucket) < cutoff {
+			return nil
+		}
+		target := instance.cold.place(key)
+		if target == nil {
+			return errNoCacheRoot
+		}
+		if err := transferCacheImage(root.Storage, target.Storage, key); err != nil {
+			log.Warn("Failed to demote image", root.location(key), err)
+			return nil
+		}
+		root.account(-info.Size)
+		target.account(info.Size)
+		demoted++
+		freed += info.Size
+		return nil
+	})
+	atomic.AddInt64(&instance.cold.demoted, demoted)
+	if demoted == 0 {
+		return
+	}
+	// the demoted images made room on a full disk
+	atomic.StoreInt32(&root.full, 0)
+	log.Info("Demoted", demoted, "images ("+strconv.FormatInt(freed, 10)+" bytes) from", root.Directory, "to the cold tier in", time.Since(started).Round(time.Millisecond))
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDemotionOfFullRootWithoutLimit(t *testing.T) {
+	hot, cold := CreateMemoryStorage(), CreateMemoryStorage()
+	cache := CreateFileCacheHandler([]CacheRoot{{Directory: "hot", Limit: math.MaxInt64, Storage: hot}}, nil, nil)
+	cache.EnableColdTier([]CacheRoot{{Directory: "cold", Limit: math.MaxInt64, Storage: cold}}, TierOptions{})
+	root := cache.roots.roots[0]
+	for i := 0; i < 10; i++ {
+		if err := storeCacheImage(hot, fmt.Sprintf("ab/cd/%08d.png", i), strings.NewReader(strings.Repeat("x", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.account(1000)
+	if excess := demotionExcess(root); excess != 0 {
+		t.Fatal("root without limit demoted before its disk ran full:", excess)
+	}
+
+	cache.roots.failed(root, syscall.ENOSPC)
+	excess := demotionExcess(root)
+	if excess != 150 {
+		t.Fatal("unexpected excess of the full root:", excess)
+	}
+	cache.demote(root, excess)
+	var demoted int64
+	cold.Walk("", func(key string, info StorageInfo) error {
+		demoted += info.Size
+		return nil
+	})
+	if demoted < excess || demoted != 1000-root.used {
+		t.Fatal("demoted", demoted, "bytes, the hot root still uses", root.used)
+	}
+	if !root.writable() {
+		t.Fatal("root still full after the demotion")
+	}
+}
+
+func TestDemotionAboveHighWatermark(t *testing.T) {
+	root := &cacheRoot{CacheRoot: CacheRoot{Limit: 1000}}
+	root.account(950)
+	if excess := demotionExcess(root); excess != 0 {
+		t.Fatal("root demoted at the high watermark:", excess)
+	}
+	root.account(10)
+	if excess := demotionExcess(root); excess != 110 {
+		t.Fatal("unexpected excess above the high watermark:", excess)
+	}
+}
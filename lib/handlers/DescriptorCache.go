@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// An open image which is used by a single reader at a time (sendfile relies on the offset of the descriptor).
+type cachedFile struct {
+	*os.File
+	info  StorageInfo
+	entry *descriptorEntry
+	cache *descriptorCache
+}
+
+// Hand the descriptor back to the cache instead of closing it.
+func (instance *cachedFile) Close() error {
+	if instance.cache == nil {
+		return instance.File.Close()
+	}
+	instance.cache.release(instance)
+	return nil
+}
+
+type descriptorEntry struct {
+	key     string
+	idle    []*cachedFile
+	element *list.Element
+}
+
+// Idle descriptors of recently served images, so hot images can be served without opening them again.
+type descriptorCache struct {
+	capacity int
+	count    int
+	entries  map[string]*descriptorEntry
+	recency  *list.List // most recently used at the front
+	mutex    sync.Mutex
+}
+
+func createDescriptorCache(capacity int) *descriptorCache {
+	return &descriptorCache{
+		capacity: capacity,
+		entries:  make(map[string]*descriptorEntry),
+		recency:  list.New(),
+	}
+}
+
+// Take an idle descriptor of the image (nil if there is none).
+func (instance *descriptorCache) acquire(key string) *cachedFile {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	entry, ok := instance.entries[key]
+	if !ok || len(entry.idle) == 0 {
+		return nil
+	}
+	file := entry.idle[len(entry.idle)-1]
+	entry.idle = entry.idle[:len(entry.idle)-1]
+	instance.count--
+	instance.recency.MoveToFront(entry.element)
+	return file
+}
+
+// Wrap a newly opened descriptor, so it's returned to the cache once it's closed.
+func (instance *descriptorCache) wrap(key string, file *os.File, info StorageInfo) *cachedFile {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	entry, ok := instance.entries[key]
+	if !ok {
+		entry = &descriptorEntry{key: key}
+		entry.element = instance.recency.PushFront(entry)
+		instance.entries[key] = entry
+	}
+	return &cachedFile{file, info, entry, instance}
+}
+
+func (instance *descriptorCache) release(file *cachedFile) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	// the image was removed or evicted while it was read
+	if instance.entries[file.entry.key] != file.entry {
+		file.File.Close()
+		return
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		file.File.Close()
+		return
+	}
+	file.entry.idle = append(file.entry.idle, file)
+	instance.count++
+	instance.recency.MoveToFront(file.entry.element)
+	for instance.count > instance.capacity {
+		instance.evict(instance.recency.Back().Value.(*descriptorEntry))
+	}
+}
+
+// Close all idle descriptors of the image (descriptors which are in use are closed once released).
+func (instance *descriptorCache) remove(key string) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if entry, ok := instance.entries[key]; ok {
+		instance.evict(entry)
+	}
+}
+
+func (instance *descriptorCache) evict(entry *descriptorEntry) {
+	for _, file := range entry.idle {
+		file.File.Close()
+	}
+	instance.count -= len(entry.idle)
+	entry.idle = nil
+	instance.recency.Remove(entry.element)
+	delete(instance.entries, entry.key)
+}
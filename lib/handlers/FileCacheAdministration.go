@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max. number of images for which hit statistics are tracked in memory (the least recently requested images are dropped first)
+	MaxTrackedImages int = 1 << 20
+	// directory (inside the cache directory) containing the list of cached images for each chapter
+	chapterDirectory string = "chapters"
+)
+
+var (
+	imagePathExpression = regexp.MustCompile(`/(data(?:-saver)?)/([a-zA-Z0-9]{32})/([^/\-\s]+)-([a-zA-Z0-9]{64})(\.[a-z]{3,4})`)
+	imageHashExpression = regexp.MustCompile(`^([a-zA-Z0-9]{64})(\.[a-z]{3,4})?$`)
+	chapterExpression   = regexp.MustCompile(`^[a-zA-Z0-9]{32}$`)
+	prefixExpression    = regexp.MustCompile(`^[a-zA-Z0-9]{1,4}$`)
+
+	errStopWalk = errors.New("stop walking")
+)
+
+type ImagePath struct {
+	Quality string // data or data-saver
+	Chapter string // chapter hash
+	Page    string // page prefix of the file name
+	Hash    string // image hash
+	Ext     string // file extension including the dot
+}
+
+// The path on the upstream server (without any token).
+func (path ImagePath) String() string {
+	return "/" + path.Quality + "/" + path.Chapter + "/" + path.Page + "-" + path.Hash + path.Ext
+}
+
+// The name of the image as used in the cache layout.
+func (path ImagePath) File() string {
+	return path.Hash + path.Ext
+}
+
+// Find the first image path within the given text (e.g. an URL or a line of an access log).
+func ParseImagePath(text string) (path ImagePath, err error) {
+	segments := imagePathExpression.FindStringSubmatch(text)
+	if len(segments) != 6 {
+		err = errors.New("no valid image path found")
+		return
+	}
+	path = ImagePath{
+		Quality: segments[1],
+		Chapter: segments[2],
+		Page:    segments[3],
+		Hash:    segments[4],
+		Ext:     segments[5],
+	}
+	return
+}
+
+type ImageHits struct {
+	Count   int64     `json:"count"`
+	LastHit time.Time `json:"last_hit"`
+}
+
+type trackedImage struct {
+	location string
+	hits     ImageHits
+}
+
+// Hits of the most recently requested images (the least recently requested image is dropped once capacity images are tracked).
+type imageHitTracker struct {
+	capacity int // MaxTrackedImages if not set
+	images   map[string]*list.Element
+	recency  *list.List // most recently requested at the front
+	mutex    sync.Mutex
+}
+
+// Record a hit of the image and provide its previous hits.
+func (instance *imageHitTracker) record(location string) (previous ImageHits) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if instance.images == nil {
+		instance.images = make(map[string]*list.Element)
+		instance.recency = list.New()
+	}
+	element, ok := instance.images[location]
+	if ok {
+		instance.recency.MoveToFront(element)
+	} else {
+		capacity := instance.capacity
+		if capacity <= 0 {
+			capacity = MaxTrackedImages
+		}
+		for instance.recency.Len() >= capacity {
+			oldest := instance.recency.Remove(instance.recency.Back()).(*trackedImage)
+			delete(instance.images, oldest.location)
+		}
+		element = instance.recency.PushFront(&trackedImage{location: location})
+		instance.images[location] = element
+	}
+	image := element.Value.(*trackedImage)
+	previous = image.hits
+	image.hits.Count++
+	image.hits.LastHit = time.Now()
+	return
+}
+
+func (instance *imageHitTracker) get(location string) (hits ImageHits) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if element, ok := instance.images[location]; ok {
+		hits = element.Value.(*trackedImage).hits
+	}
+	return
+}
+
+func (instance *imageHitTracker) remove(location string) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if element, ok := instance.images[location]; ok {
+		instance.recency.Remove(element)
+		delete(instance.images, location)
+	}
+}
+
+type CacheEntry struct {
+	File     string         `json:"file"`
+	Location string         `json:"location"`
+	Size     int64          `json:"size"`
+	Modified time.Time      `json:"modified"`
+	Hits     *ImageHits     `json:"hits,omitempty"`
+	Metadata *ImageMetadata `json:"metadata,omitempty"`
+}
+
+type CacheUsage struct {
+	Images   int64             `json:"images"`
+	Bytes    int64             `json:"bytes"`
+	Chapters int64             `json:"chapters"`
+	Roots    []CacheRootStatus `json:"roots"`
+}
+
+type PurgeResult struct {
+	Images int64 `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+func chapterLocation(directory string, chapter string) string {
+	return filepath.Join(directory, chapterDirectory, chapter[0:2], chapter)
+}
+
+// Remember that the image was cached for the given chapter, so it can be purged together with the chapter.
+func (instance *FileCacheHandler) recordChapterImage(path ImagePath) {
+	primary := instance.primary()
+	if primary == nil {
+		return
+	}
+	instance.chapterMutex.Lock()
+	defer instance.chapterMutex.Unlock()
+	manifest := chapterLocation(primary.Directory, path.Chapter)
+	err := os.MkdirAll(filepath.Dir(manifest), 0755)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(manifest, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, strings.TrimPrefix(path.String(), "/"))
+}
+
+// Resolve an image hash (with or without extension) or an image URL/path to the name of the image in the cache layout.
+func (instance *FileCacheHandler) resolveImage(image string) (file string, err error) {
+	if path, e := ParseImagePath(image); e == nil {
+		file = path.File()
+		return
+	}
+	segments := imageHashExpression.FindStringSubmatch(image)
+	if len(segments) != 3 {
+		err = errors.New("neither a valid image hash nor an image path")
+		return
+	}
+	if segments[2] != "" {
+		file = image
+		return
+	}
+	// the extension is not known, search for any cached image with this hash
+	err = fs.ErrNotExist
+	for _, root := range instance.allRoots() {
+		if !root.available() {
+			continue
+		}
+		root.Storage.Walk(layoutKey(image+"."), func(key string, info StorageInfo) error {
+			file, err = image+path.Ext(key), nil
+			return errStopWalk
+		})
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Provide size, modification time and hit statistics of a cached image.
+func (instance *FileCacheHandler) Lookup(image string) (entry CacheEntry, err error) {
+	file, err := instance.resolveImage(image)
+	if err != nil {
+		return
+	}
+	root, info, err := instance.find(file)
+	if err != nil {
+		return
+	}
+	entry = CacheEntry{
+		File:     file,
+		Location: root.location(layoutKey(file)),
+		Size:     info.Size,
+		Modified: info.Modified,
+	}
+	if hits := instance.hits.get(layoutKey(file)); hits.Count > 0 {
+		entry.Hits = &hits
+	}
+	entry.Metadata = instance.loadMetadata(layoutKey(file))
+	return
+}
+
+// Remove a single image from the cache.
+func (instance *FileCacheHandler) PurgeImage(image string) (result PurgeResult, err error) {
+	file, err := instance.resolveImage(image)
+	if err != nil {
+		return
+	}
+	instance.purgeImageFile(file, &result)
+	return
+}
+
+// Remove all cached images of the given chapter (only images cached since chapters are tracked can be found).
+func (instance *FileCacheHandler) PurgeChapter(chapter string) (result PurgeResult, err error) {
+	if !chapterExpression.MatchString(chapter) {
+		err = errors.New("invalid chapter hash")
+		return
+	}
+	primary := instance.primary()
+	if primary == nil {
+		err = errors.New("chapters are only tracked in cache roots on the local file system")
+		return
+	}
+	instance.chapterMutex.Lock()
+	defer instance.chapterMutex.Unlock()
+	manifest := chapterLocation(primary.Directory, chapter)
+	file, err := os.Open(manifest)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path, e := ParseImagePath("/" + scanner.Text()); e == nil {
+			instance.purgeImageFile(path.File(), &result)
+		}
+	}
+	file.Close()
+	err = os.Remove(manifest)
+	return
+}
+
+// Remove all cached images with the given hash prefix.
+// The cache layout only preserves the first four characters of the hash in the directory structure, so longer prefixes are rejected.
+func (instance *FileCacheHandler) PurgePrefix(prefix string) (result PurgeResult, err error) {
+	if !prefixExpression.MatchString(prefix) {
+		err = errors.New("prefix must consist of 1 to 4 characters of the image hash")
+		return
+	}
+	if len(prefix) > 2 {
+		prefix = prefix[0:2] + "/" + prefix[2:]
+	}
+	for _, root := range instance.allRoots() {
+		if !root.available() {
+			continue
+		}
+		root.Storage.Walk(prefix, func(key string, info StorageInfo) error {
+			instance.purgeFile(root, key, &result)
+			return nil
+		})
+	}
+	return
+}
+
+// Remove the image from all roots (an image may be stored more than once, e.g. during rebalancing).
+func (instance *FileCacheHandler) purgeImageFile(file string, result *PurgeResult) {
+	for _, root := range instance.allRoots() {
+		if root.available() {
+			instance.purgeFile(root, layoutKey(file), result)
+		}
+	}
+}
+
+func (instance *FileCacheHandler) purgeFile(root *cacheRoot, key string, result *PurgeResult) {
+	info, err := root.Storage.Stat(key)
+	if err != nil {
+		return
+	}
+	if root.Storage.Delete(key) == nil {
+		result.Images++
+		result.Bytes += info.Size
+		root.account(-info.Size)
+		instance.forget(key)
+	}
+}
+
+// Drop all in-memory state of an image which was removed from the cache.
+func (instance *FileCacheHandler) forget(key string) {
+	instance.hits.remove(key)
+	instance.removeMetadata(key)
+	if instance.memory != nil {
+		instance.memory.Remove(key)
+	}
+}
+
+// Determine the total footprint of the cache by walking all cache roots.
+func (instance *FileCacheHandler) Usage() (usage CacheUsage, err error) {
+	for _, root := range instance.allRoots() {
+		if !root.available() {
+			continue
+		}
+		err = root.Storage.Walk("", func(key string, info StorageInfo) error {
+			usage.Images++
+			usage.Bytes += info.Size
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	if primary := instance.primary(); primary != nil {
+		chapters := filepath.Join(primary.Directory, chapterDirectory)
+		err = filepath.WalkDir(chapters, func(location string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				usage.Chapters++
+			}
+			return nil
+		})
+	}
+	for _, tier := range instance.allTiers() {
+		usage.Roots = append(usage.Roots, tier.status()...)
+	}
+	return
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestImageHitTrackerDropsLeastRecentlyRequestedImages(t *testing.T) {
+	tracker := imageHitTracker{capacity: 100}
+	tracker.record("hot")
+	for i := 0; i < 250; i++ {
+		tracker.record(strconv.Itoa(i))
+		if i%10 == 0 {
+			tracker.record("hot")
+		}
+	}
+	if len(tracker.images) != 100 || tracker.recency.Len() != 100 {
+		t.Fatal("tracker exceeds its capacity:", len(tracker.images), "images")
+	}
+	if hits := tracker.get("hot"); hits.Count != 26 {
+		t.Fatal("hits of a frequently requested image lost:", hits.Count)
+	}
+	if hits := tracker.get("0"); hits.Count != 0 {
+		t.Fatal("least recently requested image still tracked")
+	}
+
+	// images requested after the tracker is full are still counted, so they can be promoted
+	tracker.record("new")
+	if previous := tracker.record("new"); previous.Count != 1 || previous.LastHit.IsZero() {
+		t.Fatal("hits of a new image not tracked once the tracker is full:", previous.Count)
+	}
+	tracker.remove("new")
+	if hits := tracker.get("new"); hits.Count != 0 || len(tracker.images) != tracker.recency.Len() {
+		t.Fatal("removed image still tracked")
+	}
+}
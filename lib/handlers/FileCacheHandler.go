@@ -1,33 +1,111 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	mdath "mdath/lib"
 	"mdath/log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// size of the buffers for copying cached images which can't be sent with sendfile
+const copyBufferSize int = 256 << 10
+
+var copyBuffers = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, copyBufferSize)
+	return &buffer
+}}
+
+type CacheStatistics struct {
+	Hits     int64                    `json:"hits"`
+	Misses   int64                    `json:"misses"`
+	Blocked  int64                    `json:"blocked"`
+	Errors   int64                    `json:"errors"`
+	Rejected int64                    `json:"rejected"` // invalid images received from the upstream server
+	Memory   *MemoryCacheStatistics   `json:"memory,omitempty"`
+	Negative *NegativeCacheStatistics `json:"negative,omitempty"`
+	Tiers    []CacheTierStatistics    `json:"tiers"`
+	Roots    []CacheRootStatus        `json:"roots"`
+	Upstream UpstreamStatus           `json:"upstream"`
+}
+
 type FileCacheHandler struct {
-	directory string
-	upstream  *string
-	validator *mdath.RequestValidator
+	roots        *cacheRoots
+	upstream     *string
+	validator    *mdath.RequestValidator
+	statistics   CacheStatistics
+	hits         imageHitTracker
+	chapterMutex sync.Mutex
+	memory       *MemoryCache
+	cold         *cacheRoots
+	tiers        TierOptions
+	promotions   chan promotion
+	outage       OutageOptions
+	health       upstreamHealth
+	negative     *NegativeCache
+	client       *mdath.UpstreamClient
+	maxImageSize int64
+	metadata     metadataCache
+	exhausted    int32 // all roots are full or offline
 }
 
-func CreateFileCacheHandler(directory string, upstream *string, validator *mdath.RequestValidator) (instance *FileCacheHandler) {
+// Instantiate a new FileCacheHandler which spreads the cached images across the given roots (at least one root is required).
+func CreateFileCacheHandler(roots []CacheRoot, upstream *string, validator *mdath.RequestValidator) (instance *FileCacheHandler) {
 	return &FileCacheHandler{
-		directory: directory,
-		upstream:  upstream,
-		validator: validator,
+		roots:        createCacheRoots(roots, HotTier),
+		upstream:     upstream,
+		validator:    validator,
+		client:       mdath.CreateUpstreamClient(mdath.UpstreamClientOptions{Retries: mdath.RequestRetries}),
+		maxImageSize: MaxImageSize,
+	}
+}
+
+// Reject images received from the upstream server which are larger than limit bytes (0 for unlimited).
+func (instance *FileCacheHandler) LimitImageSize(limit int64) {
+	instance.maxImageSize = limit
+}
+
+// Replace the client (with the default options) which is used for requests to the upstream servers.
+func (instance *FileCacheHandler) UseUpstreamClient(client *mdath.UpstreamClient) {
+	instance.client = client
+}
+
+// Determine the used space of each cache root, re-check failed roots periodically and rebalance the images when roots were added.
+// Images are moved between the hot and the cold tier in the background (if a cold tier is enabled).
+func (instance *FileCacheHandler) StartRootMonitor() {
+	for _, tier := range instance.allTiers() {
+		tier.start()
+	}
+	instance.startTiering()
+}
+
+// Answer repeated requests for images which the upstream server reported as missing without asking it again (for ttl).
+func (instance *FileCacheHandler) EnableNegativeCache(capacity int, ttl time.Duration) {
+	if capacity > 0 && ttl > 0 {
+		instance.negative = CreateNegativeCache(capacity, ttl)
+	}
+}
+
+// Serve the hottest images from memory (capacity and maxObject in bytes) in front of the cache directory.
+func (instance *FileCacheHandler) EnableMemoryCache(capacity int64, maxObject int64) {
+	if capacity > 0 {
+		instance.memory = CreateMemoryCache(capacity, maxObject)
 	}
 }
 
 func (instance *FileCacheHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
 	path, file, err := instance.validator.ExtractValidatedPath(request)
 	if err != nil {
+		atomic.AddInt64(&instance.statistics.Blocked, 1)
 		log.Verbose("Request (Blocked):", request.RemoteAddr, "=>", request.Host+request.URL.Path, err)
 		response.WriteHeader(http.StatusForbidden)
 		return
@@ -35,98 +113,248 @@ func (instance *FileCacheHandler) ServeHTTP(response http.ResponseWriter, reques
 		log.Verbose("Request (Accepted):", request.RemoteAddr, "=>", request.Host+request.URL.Path)
 	}
 
-	file = filepath.Join(instance.directory, file[0:2], file[2:4], file[56:])
-	_, err = os.Stat(file)
+	key := layoutKey(file)
+	if instance.memory != nil {
+		if data, _, ok := instance.memory.Get(key); ok {
+			instance.hits.record(key)
+			instance.serveImageFromMemory(key, data, response, request)
+			log.Verbose("Response (Memory HIT):", request.RemoteAddr, "<=", key)
+			return
+		}
+	}
+	root, _, err := instance.find(file)
 	if err == nil {
-		serveFileFromCache(file, response, request)
-		log.Verbose("Response (Cache HIT):", request.RemoteAddr, "<=", file)
-	} else if os.IsNotExist(err) {
-		url := *instance.upstream + path
-		cacheFileFromUpstream(url, file, response, request)
-		log.Verbose("Response (Cache MISS):", request.RemoteAddr, "<=", url)
-	} else {
-		response.WriteHeader(http.StatusInternalServerError)
-		log.Warn("Failed to determine cached image status", err)
+		err = instance.serveFileFromCache(key, root, response, request)
+		if errors.Is(err, fs.ErrNotExist) {
+			// the image was moved into another tier or root in the meantime
+			if root, _, err = instance.find(file); err == nil {
+				err = instance.serveFileFromCache(key, root, response, request)
+			}
+		}
+	}
+	if err == nil {
+		atomic.AddInt64(&instance.statistics.Hits, 1)
+		instance.recordTierHit(key, root, instance.hits.record(key))
+		log.Verbose("Response (Cache HIT):", request.RemoteAddr, "<=", root.location(key))
+	} else if errors.Is(err, fs.ErrNotExist) {
+		if instance.negative != nil {
+			if status, ok := instance.negative.Get(path); ok {
+				response.Header().Set("X-Cache", "NEGATIVE")
+				response.WriteHeader(status)
+				log.Verbose("Response (Negative HIT):", request.RemoteAddr, "<=", file)
+				return
+			}
+		}
+		atomic.AddInt64(&instance.statistics.Misses, 1)
+		image, imageErr := ParseImagePath(path)
+		source, err := instance.fetchUpstream(request.Context(), path)
+		if err != nil {
+			log.Warn("Failed to receive image from upstream server", err)
+			if imageErr != nil || !instance.serveStaleSibling(image, response, request) {
+				response.WriteHeader(http.StatusBadGateway)
+			}
+			return
+		}
+		defer source.Body.Close()
+		if instance.negative != nil && (source.StatusCode == http.StatusNotFound || source.StatusCode == http.StatusGone) {
+			instance.negative.Add(path, source.StatusCode)
+		}
+		if instance.cacheFileFromUpstream(source, file, response) && imageErr == nil {
+			instance.recordChapterImage(image)
+		}
+		log.Verbose("Response (Cache MISS):", request.RemoteAddr, "<=", source.Request.URL)
 	}
 }
 
-func serveFileFromCache(file string, response http.ResponseWriter, request *http.Request) {
-	filereader, info, err := openCacheImage(file)
-	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		return
+// Provide a snapshot of the request counters since the handler was created.
+func (instance *FileCacheHandler) Statistics() CacheStatistics {
+	var memory *MemoryCacheStatistics
+	if instance.memory != nil {
+		statistics := instance.memory.Statistics()
+		memory = &statistics
 	}
-	defer filereader.Close()
+	var negative *NegativeCacheStatistics
+	if instance.negative != nil {
+		statistics := instance.negative.Statistics()
+		negative = &statistics
+	}
+	var roots []CacheRootStatus
+	for _, tier := range instance.allTiers() {
+		roots = append(roots, tier.status()...)
+	}
+	return CacheStatistics{
+		Hits:     atomic.LoadInt64(&instance.statistics.Hits),
+		Misses:   atomic.LoadInt64(&instance.statistics.Misses),
+		Blocked:  atomic.LoadInt64(&instance.statistics.Blocked),
+		Errors:   atomic.LoadInt64(&instance.statistics.Errors),
+		Rejected: atomic.LoadInt64(&instance.statistics.Rejected),
+		Memory:   memory,
+		Negative: negative,
+		Tiers:    instance.tierStatistics(),
+		Roots:    roots,
+		Upstream: instance.UpstreamStatus(),
+	}
+}
+
+// Verify that new images can be stored in at least one of the cache roots.
+func (instance *FileCacheHandler) CheckDirectory() (err error) {
+	err = errNoCacheRoot
+	for _, root := range instance.allRoots() {
+		if !root.writable() {
+			continue
+		}
+		if e := probeStorage(root.Storage); e != nil {
+			instance.roots.failed(root, e)
+			continue
+		}
+		err = nil
+	}
+	return
+}
 
+func writeImageHeaders(file string, size int64, response http.ResponseWriter) {
 	response.Header().Set("Content-Type", getImageMimeType(file))
-	response.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	response.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	response.Header().Set("Access-Control-Allow-Origin", "*")
 	response.Header().Set("Access-Control-Expose-Headers", "*")
 	response.Header().Set("Cache-Control", "public, max-age=1209600")
 	response.Header().Set("Timing-Allow-Origin", "*")
 	response.Header().Set("X-Content-Type-Options", "nosniff")
 	response.Header().Set("X-Cache", "HIT")
+}
 
+func (instance *FileCacheHandler) serveImageFromMemory(file string, data []byte, response http.ResponseWriter, request *http.Request) {
+	if instance.writeCachedHeaders(file, int64(len(data)), response, request) {
+		return
+	}
 	response.WriteHeader(http.StatusOK)
-	io.Copy(response, filereader)
+	response.Write(data)
 }
 
-func cacheFileFromUpstream(upstream string, file string, response http.ResponseWriter, request *http.Request) {
-	source, err := http.Get(upstream)
-	if err != nil {
-		log.Warn("Failed to receive image from upstream server", err)
-		response.WriteHeader(http.StatusBadGateway)
+// Serve the image from the given root, missing images are reported without writing a response.
+func (instance *FileCacheHandler) serveFileFromCache(file string, root *cacheRoot, response http.ResponseWriter, request *http.Request) (err error) {
+	filereader, info, err := root.Storage.Get(file)
+	if errors.Is(err, fs.ErrNotExist) {
 		return
 	}
-	defer source.Body.Close()
+	if err != nil {
+		log.Warn("Failed to open cached image", err)
+		atomic.AddInt64(&instance.statistics.Errors, 1)
+		instance.roots.failed(root, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	defer filereader.Close()
 
-	var destination io.Writer = response
-	if source.StatusCode == 200 {
-		filewriter, err := createCacheImage(file)
-		if err == nil {
-			defer filewriter.Close()
-			destination = io.MultiWriter(response, filewriter)
+	if instance.memory != nil && instance.memory.Admits(file, info.Size) {
+		data, err := io.ReadAll(filereader)
+		if err != nil {
+			log.Warn("Failed to read cached image", err)
+			response.WriteHeader(http.StatusInternalServerError)
+			return nil
 		}
+		instance.memory.Offer(file, data, info.Modified)
+		instance.serveImageFromMemory(file, data, response, request)
+		return nil
 	}
 
-	for key, values := range source.Header {
-		for _, value := range values {
-			response.Header().Add(key, value)
-		}
+	if instance.writeCachedHeaders(file, info.Size, response, request) {
+		return
 	}
-	response.Header().Set("X-Cache", "MISS")
+	response.WriteHeader(http.StatusOK)
+	sendCachedImage(filereader, response, request)
+	return
+}
 
-	response.WriteHeader(source.StatusCode)
-	io.Copy(destination, source.Body)
+// Send the image with sendfile on plain connections, otherwise copy it with a large pooled buffer (e.g. for TLS connections).
+func sendCachedImage(reader io.Reader, response http.ResponseWriter, request *http.Request) {
+	if cached, ok := reader.(*cachedFile); ok && request.TLS == nil {
+		if destination, ok := response.(io.ReaderFrom); ok {
+			destination.ReadFrom(cached.File)
+			return
+		}
+	}
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+	// hide ReadFrom and WriteTo, as they would use their own (small) buffers
+	io.CopyBuffer(struct{ io.Writer }{response}, struct{ io.Reader }{reader}, *buffer)
 }
 
-func openCacheImage(file string) (filereader *os.File, fileinfo fs.FileInfo, err error) {
-	filereader, err = os.Open(file)
-	if err != nil {
-		log.Warn("Failed to open cached image", err)
+// Forward the response of the upstream server and store the image in the responsible cache root (if any root is available).
+// Images which fail the validation are neither forwarded nor stored, other responses (e.g. 404) are forwarded as is.
+func (instance *FileCacheHandler) cacheFileFromUpstream(source *http.Response, file string, response http.ResponseWriter) (cached bool) {
+	if source.StatusCode != http.StatusOK {
+		copyUpstreamHeaders(source.Header, response.Header())
+		response.Header().Set("X-Cache", "MISS")
+		response.WriteHeader(source.StatusCode)
+		io.Copy(response, source.Body)
 		return
 	}
-	fileinfo, err = filereader.Stat()
+	body, err := validateUpstreamImage(source, file, instance.maxImageSize)
 	if err != nil {
-		filereader.Close()
-		log.Warn("Failed to access info of cached image", err)
+		atomic.AddInt64(&instance.statistics.Rejected, 1)
+		log.Warn("Rejected image from upstream server", source.Request.URL, err)
+		response.WriteHeader(http.StatusBadGateway)
 		return
 	}
-	return
-}
 
-func createCacheImage(file string) (filewriter *os.File, err error) {
-	err = os.MkdirAll(filepath.Dir(file), 0755)
-	if err != nil {
-		log.Warn("Failed to create cache directory tree", err)
+	var destination io.Writer = response
+	var filewriter StorageWriter
+	target := instance.place(layoutKey(file))
+	if target != nil {
+		filewriter, err = target.Storage.Put(layoutKey(file))
+		if err == nil {
+			destination = io.MultiWriter(response, filewriter)
+		} else {
+			log.Warn("Failed to create cached image", err)
+			instance.roots.failed(target, err)
+		}
+	}
+
+	metadata := &ImageMetadata{
+		Upstream: source.Request.URL.String(),
+		Fetched:  time.Now(),
+		Header:   make(http.Header),
+	}
+	copyUpstreamHeaders(source.Header, metadata.Header)
+	checksum := sha256.New()
+	destination = io.MultiWriter(destination, checksum)
+
+	writeImageHeaders(file, source.ContentLength, response)
+	writeMetadataHeaders(metadata, response)
+	if source.ContentLength < 0 {
+		response.Header().Del("Content-Length")
+	}
+	response.Header().Set("X-Cache", "MISS")
+	response.WriteHeader(http.StatusOK)
+	if instance.maxImageSize > 0 {
+		body = io.LimitReader(body, instance.maxImageSize+1)
+	}
+	written, err := io.Copy(destination, body)
+	if err == nil && source.ContentLength >= 0 && written != source.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", written, source.ContentLength)
+	}
+	if err == nil && instance.maxImageSize > 0 && written > instance.maxImageSize {
+		err = fmt.Errorf("image exceeds the max. size of %d bytes", instance.maxImageSize)
+		log.Warn("Rejected image from upstream server", source.Request.URL, err)
+	}
+	if filewriter == nil {
 		return
 	}
-	filewriter, err = os.Create(file)
+	// incomplete images (e.g. the client or the upstream server aborted the transfer) are discarded
 	if err != nil {
-		log.Warn("Failed to create cached image", err)
+		filewriter.Abort()
 		return
 	}
-	return
+	if err = filewriter.Commit(); err != nil {
+		log.Warn("Failed to store cached image", err)
+		instance.roots.failed(target, err)
+		return
+	}
+	target.account(written)
+	metadata.Size, metadata.SHA256 = written, hex.EncodeToString(checksum.Sum(nil))
+	instance.storeMetadata(layoutKey(file), metadata)
+	return true
 }
 
 func getImageMimeType(file string) string {
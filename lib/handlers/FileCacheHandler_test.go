@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	mdath "mdath/lib"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFileCacheHandlerServesMissThenHit(t *testing.T) {
+	image := []byte("\x89PNG\r\n\x1a\nimage data")
+	path := "/data/0123456789abcdef0123456789abcdef/x1-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.png"
+	var requests int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if request.URL.Path != path {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		response.Header().Set("Content-Type", "image/png")
+		response.Write(image)
+	}))
+	defer upstream.Close()
+
+	validator := new(mdath.RequestValidator)
+	validator.Update(true, "")
+	storage := CreateMemoryStorage()
+	cache := CreateFileCacheHandler([]CacheRoot{{Directory: "memory", Limit: 1 << 20, Storage: storage}}, &upstream.URL, validator)
+
+	for _, expected := range []string{"MISS", "HIT"} {
+		response := httptest.NewRecorder()
+		cache.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/token"+path, nil))
+		if response.Code != http.StatusOK || response.Body.String() != string(image) {
+			t.Fatalf("%s responded with status %d and %q", expected, response.Code, response.Body.String())
+		}
+		if cache := response.Header().Get("X-Cache"); cache != expected {
+			t.Fatal("expected a cache", expected, "instead of", cache)
+		}
+		if response.Header().Get("Content-Type") != "image/png" {
+			t.Fatal("unexpected content type", response.Header().Get("Content-Type"))
+		}
+	}
+	if requests != 1 {
+		t.Fatal("upstream server requested", requests, "times")
+	}
+	if _, err := storage.Stat(layoutKey(path[len(path)-68:])); err != nil {
+		t.Fatal("image not stored:", err)
+	}
+	if statistics := cache.Statistics(); statistics.Hits != 1 || statistics.Misses != 1 {
+		t.Fatal("unexpected statistics", statistics.Hits, "hits and", statistics.Misses, "misses")
+	}
+}
+
+func TestFileCacheHandlerRequiresClusterSignature(t *testing.T) {
+	path := "/data/0123456789abcdef0123456789abcdef/x1-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.png"
+	var requests int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		response.Header().Set("Content-Type", "image/png")
+		response.Write([]byte("\x89PNG\r\n\x1a\nimage data"))
+	}))
+	defer upstream.Close()
+
+	signer, err := mdath.CreateRequestSigner("0123456789abcdef0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := mdath.CreateRequestSigner("fedcba9876543210fedc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := new(mdath.RequestValidator)
+	validator.Update(true, "")
+	validator.RequireSignature(signer)
+	cache := CreateFileCacheHandler([]CacheRoot{{Directory: "memory", Limit: 1 << 20, Storage: CreateMemoryStorage()}}, &upstream.URL, validator)
+
+	for _, sign := range []func(*http.Request){nil, other.Sign} {
+		request := httptest.NewRequest(http.MethodGet, "/token"+path, nil)
+		if sign != nil {
+			sign(request)
+		}
+		response := httptest.NewRecorder()
+		cache.ServeHTTP(response, request)
+		if response.Code != http.StatusForbidden {
+			t.Fatal("request without valid cluster signature answered with status", response.Code)
+		}
+	}
+	if requests != 0 {
+		t.Fatal("upstream server requested for a forbidden request")
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/token"+path, nil)
+	signer.Sign(request)
+	response := httptest.NewRecorder()
+	cache.ServeHTTP(response, request)
+	if response.Code != http.StatusOK || requests != 1 {
+		t.Fatal("signed request answered with status", response.Code)
+	}
+}
+
+// number of distinct images fetched by the serving benchmarks
+const benchmarkImages int = 200
+
+// Serve cached images of the given size (like the README benchmark), each request fetches another image.
+func benchmarkServeFileFromCache(b *testing.B, size int, tls bool, descriptors bool) {
+	storage := CreateDirectoryStorage(b.TempDir())
+	if descriptors {
+		storage.CacheDescriptors(OpenFiles)
+	}
+	cache := CreateFileCacheHandler([]CacheRoot{{Directory: "benchmark", Limit: 1 << 40, Storage: storage}}, nil, nil)
+	root := cache.roots.roots[0]
+	keys := make([]string, benchmarkImages)
+	data := make([]byte, size)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%02x/%02x/%08x.png", i%256, i/256, i)
+		writer, err := storage.Put(keys[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+		writer.Write(data)
+		if err = writer.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		cache.serveFileFromCache(request.URL.Path[1:], root, response, request)
+	})
+	var server *httptest.Server
+	if tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	defer server.Close()
+	client := server.Client()
+	client.Transport.(*http.Transport).MaxIdleConnsPerHost = 64
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			response, err := client.Get(server.URL + "/" + keys[i%len(keys)])
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				b.Fatal("unexpected status", response.StatusCode)
+			}
+		}
+	})
+}
+
+func BenchmarkServeFileFromCache(b *testing.B) {
+	for _, size := range []int{32 << 10, 300 << 10} {
+		for _, tls := range []bool{false, true} {
+			for _, descriptors := range []bool{false, true} {
+				connection, opening := "plain", "open"
+				if tls {
+					connection = "tls"
+				}
+				if descriptors {
+					opening = "descriptors"
+				}
+				name := fmt.Sprintf("%dKB/%s/%s", size>>10, connection, opening)
+				b.Run(name, func(b *testing.B) {
+					benchmarkServeFileFromCache(b, size, tls, descriptors)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type ImportMode int
+
+const (
+	// copy the image into the cache (the source remains untouched)
+	ImportCopy ImportMode = 0
+	// move the image into the cache (falls back to copy + delete when the source can't be renamed)
+	ImportMove ImportMode = 1
+	// hardlink the image into the cache (falls back to copy when the source can't be linked)
+	ImportLink ImportMode = 2
+)
+
+type ImportOptions struct {
+	Mode   ImportMode
+	DryRun bool
+}
+
+// Metadata header of an image stored by the official MangaDex@Home client (2.x).
+type officialImageMetadata struct {
+	ContentType  string `json:"contentType"`
+	LastModified string `json:"lastModified"`
+	Size         int64  `json:"size"`
+}
+
+var mimeTypeExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/jpg":  ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Detect the image type by its magic bytes and provide the corresponding file extension.
+func detectImageExtension(header []byte) string {
+	for _, extension := range []string{".png", ".jpg", ".gif", ".webp"} {
+		if matchMagicBytes(extension, header) {
+			return extension
+		}
+	}
+	return ""
+}
+
+// Determine the offset of the image data and its file extension.
+// Images of the official client (2.x) are prefixed with a length-prefixed JSON header, other files must be raw images.
+func parseImportHeader(reader *bufio.Reader) (offset int64, extension string, size int64, err error) {
+	peek, _ := reader.Peek(2)
+	if len(peek) == 2 {
+		length := int(binary.BigEndian.Uint16(peek))
+		if header, e := reader.Peek(2 + length); e == nil && length > 0 && header[2] == '{' {
+			metadata := new(officialImageMetadata)
+			if json.Unmarshal(header[2:], metadata) == nil && metadata.ContentType != "" {
+				extension, offset, size = mimeTypeExtensions[metadata.ContentType], int64(2+length), metadata.Size
+				if extension == "" {
+					err = errors.New("unsupported content type " + metadata.ContentType)
+				}
+				return
+			}
+		}
+	}
+	peek, _ = reader.Peek(12)
+	extension = detectImageExtension(peek)
+	if extension == "" {
+		err = errors.New("unknown file format")
+	}
+	return
+}
+
+// Verify an image of another cache and store it under its SHA-256 hash in the cache layout.
+// Images which are already cached are skipped (imported = false).
+func (instance *FileCacheHandler) ImportImage(source string, options ImportOptions) (file string, imported bool, err error) {
+	input, err := os.Open(source)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+	reader := bufio.NewReaderSize(input, 128*1024)
+	offset, extension, expected, err := parseImportHeader(reader)
+	if err != nil {
+		return
+	}
+	if _, err = reader.Discard(int(offset)); err != nil {
+		return
+	}
+	header, _ := reader.Peek(12)
+	if !matchMagicBytes(extension, header) {
+		err = errors.New("magic bytes mismatch")
+		return
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return
+	}
+	if size == 0 || (expected > 0 && expected != size) {
+		err = errors.New("size mismatch")
+		return
+	}
+	file = hex.EncodeToString(hash.Sum(nil)) + extension
+	if _, _, e := instance.find(file); e == nil {
+		return
+	}
+	key := layoutKey(file)
+	target := instance.place(key)
+	if target == nil {
+		err = errNoCacheRoot
+		return
+	}
+	imported = true
+	if options.DryRun {
+		return
+	}
+	defer func() {
+		if err == nil {
+			target.account(size)
+		}
+	}()
+	// images without metadata header can be moved or linked into the directory layout as is
+	if directory, ok := target.Storage.(*DirectoryStorage); ok && offset == 0 && options.Mode != ImportCopy {
+		destination := directory.Location(key)
+		if err = os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			instance.roots.failed(target, err)
+			return
+		}
+		if options.Mode == ImportMove && os.Rename(source, destination) == nil {
+			directory.invalidate(key)
+			return
+		}
+		if options.Mode == ImportLink && os.Link(source, destination) == nil {
+			directory.invalidate(key)
+			return
+		}
+	}
+	if _, err = input.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	if err = storeCacheImage(target.Storage, key, input); err != nil {
+		return
+	}
+	if options.Mode == ImportMove {
+		err = os.Remove(source)
+	}
+	return
+}
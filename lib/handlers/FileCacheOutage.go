@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mdath/log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// default pause between two rounds of attempts across the upstream servers (multiplied by the number of the round)
+	UpstreamBackoff = 500 * time.Millisecond
+	// number of consecutive failed attempts after which the upstream servers are reported as unavailable
+	outageThreshold int64 = 3
+)
+
+// Handling of cache misses while the upstream server is unavailable (the zero value fails fast with a single attempt).
+type OutageOptions struct {
+	Fallbacks []string      // upstream servers which are tried after the primary upstream server
+	Retries   int           // additional rounds of attempts across all upstream servers
+	Backoff   time.Duration // pause between two rounds
+}
+
+type UpstreamStatus struct {
+	Upstream  string     `json:"upstream"`
+	Fallbacks []string   `json:"fallbacks,omitempty"`
+	Outage    bool       `json:"outage"`
+	Since     *time.Time `json:"since,omitempty"` // time of the first of the consecutive failed attempts
+	Failures  int64      `json:"failures"`        // consecutive failed attempts
+	LastError string     `json:"last_error,omitempty"`
+	Retries   int64      `json:"retries"`       // attempts after the first failed attempt of a miss
+	Answered  int64      `json:"fallback_hits"` // misses answered by a fallback upstream server
+	Stale     int64      `json:"stale"`         // misses answered with a sibling image while all upstream servers failed
+}
+
+type upstreamHealth struct {
+	failures  int64
+	since     time.Time
+	lastError string
+	retries   int64
+	fallbacks int64
+	stale     int64
+	mutex     sync.Mutex
+}
+
+// Retry misses across the given fallback upstream servers when the upstream server fails (5xx or unreachable).
+func (instance *FileCacheHandler) EnableOutageMode(options OutageOptions) {
+	if options.Retries < 0 {
+		options.Retries = 0
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = UpstreamBackoff
+	}
+	instance.outage = options
+}
+
+// Request the image from the upstream servers until one of them doesn't fail, the caller has to close the body of the response.
+// Client errors (e.g. 404) are not retried, as all upstream servers would respond the same.
+func (instance *FileCacheHandler) fetchUpstream(ctx context.Context, path string) (source *http.Response, err error) {
+	upstreams := append([]string{*instance.upstream}, instance.outage.Fallbacks...)
+	if instance.upstreamOutage() && len(upstreams) > 1 {
+		// don't wait for the failing upstream server first
+		upstreams = append(upstreams[1:], upstreams[0])
+	}
+	for round := 0; round <= instance.outage.Retries; round++ {
+		if round > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(round) * instance.outage.Backoff):
+			}
+		}
+		for index, upstream := range upstreams {
+			if round > 0 || index > 0 {
+				atomic.AddInt64(&instance.health.retries, 1)
+			}
+			request, e := http.NewRequestWithContext(ctx, http.MethodGet, upstream+path, nil)
+			if e != nil {
+				return nil, e
+			}
+			source, err = instance.client.Do(request)
+			if err == nil && source.StatusCode < 500 {
+				if upstream != *instance.upstream {
+					atomic.AddInt64(&instance.health.fallbacks, 1)
+				}
+				instance.upstreamSucceeded()
+				return
+			}
+			if err == nil {
+				source.Body.Close()
+				source, err = nil, fmt.Errorf("upstream server %s responded with status %d", upstream, source.StatusCode)
+			}
+			if ctx.Err() != nil {
+				// the client is gone, which says nothing about the upstream server
+				return nil, err
+			}
+			instance.upstreamFailed(err)
+		}
+	}
+	return
+}
+
+func (instance *FileCacheHandler) upstreamSucceeded() {
+	health := &instance.health
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if health.failures >= outageThreshold {
+		log.Info("Upstream server is available again after an outage of", time.Since(health.since).Round(time.Second))
+	}
+	health.failures = 0
+}
+
+func (instance *FileCacheHandler) upstreamFailed(err error) {
+	health := &instance.health
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	if health.failures == 0 {
+		health.since = time.Now()
+	}
+	health.failures++
+	health.lastError = err.Error()
+	if health.failures == outageThreshold {
+		log.Error("Upstream server is unavailable, misses are answered with stale images where possible", err)
+	}
+}
+
+func (instance *FileCacheHandler) upstreamOutage() bool {
+	instance.health.mutex.Lock()
+	defer instance.health.mutex.Unlock()
+	return instance.health.failures >= outageThreshold
+}
+
+// Report an ongoing outage of the upstream servers (cache hits are still served).
+func (instance *FileCacheHandler) CheckUpstream() error {
+	status := instance.UpstreamStatus()
+	if !status.Outage {
+		return nil
+	}
+	return fmt.Errorf("outage since %s (%d failed attempts, last error: %s)", status.Since.Format(time.RFC3339), status.Failures, status.LastError)
+}
+
+func (instance *FileCacheHandler) UpstreamStatus() (status UpstreamStatus) {
+	health := &instance.health
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	status = UpstreamStatus{
+		Upstream:  *instance.upstream,
+		Fallbacks: instance.outage.Fallbacks,
+		Outage:    health.failures >= outageThreshold,
+		Failures:  health.failures,
+		LastError: health.lastError,
+		Retries:   atomic.LoadInt64(&health.retries),
+		Answered:  atomic.LoadInt64(&health.fallbacks),
+		Stale:     atomic.LoadInt64(&health.stale),
+	}
+	if health.failures > 0 {
+		since := health.since
+		status.Since = &since
+	}
+	return
+}
+
+// Marks the image as stale, so it isn't kept by browsers and CDNs in place of the requested image.
+type staleResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (instance staleResponseWriter) WriteHeader(status int) {
+	instance.Header().Set("X-Cache", "STALE")
+	instance.Header().Set("Cache-Control", "no-store")
+	instance.ResponseWriter.WriteHeader(status)
+}
+
+// Answer a miss with another cached image of the same page (e.g. data-saver instead of data) while the upstream servers are unavailable.
+func (instance *FileCacheHandler) serveStaleSibling(image ImagePath, response http.ResponseWriter, request *http.Request) bool {
+	for _, sibling := range instance.chapterImages(image.Chapter) {
+		if sibling.Page != image.Page || sibling.Hash == image.Hash {
+			continue
+		}
+		root, _, err := instance.find(sibling.File())
+		if err != nil {
+			continue
+		}
+		if instance.serveFileFromCache(layoutKey(sibling.File()), root, staleResponseWriter{response}, request) == nil {
+			atomic.AddInt64(&instance.health.stale, 1)
+			log.Verbose("Response (Stale):", request.RemoteAddr, "<=", root.location(layoutKey(sibling.File())))
+			return true
+		}
+	}
+	return false
+}
+
+// The images which were cached for the chapter (empty if chapters aren't tracked).
+func (instance *FileCacheHandler) chapterImages(chapter string) (images []ImagePath) {
+	primary := instance.primary()
+	if primary == nil {
+		return
+	}
+	instance.chapterMutex.Lock()
+	defer instance.chapterMutex.Unlock()
+	file, err := os.Open(chapterLocation(primary.Directory, chapter))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("Failed to read chapter list", err)
+		}
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path, err := ParseImagePath("/" + scanner.Text()); err == nil {
+			images = append(images, path)
+		}
+	}
+	return
+}
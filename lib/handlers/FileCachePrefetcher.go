@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Response which only keeps track of the status and the number of written bytes (used for filling the cache without a client).
+type discardResponseWriter struct {
+	header http.Header
+	status int
+	size   int64
+}
+
+func (instance *discardResponseWriter) Header() http.Header {
+	if instance.header == nil {
+		instance.header = make(http.Header)
+	}
+	return instance.header
+}
+
+func (instance *discardResponseWriter) Write(data []byte) (int, error) {
+	if instance.status == 0 {
+		instance.status = http.StatusOK
+	}
+	instance.size += int64(len(data))
+	return len(data), nil
+}
+
+func (instance *discardResponseWriter) WriteHeader(status int) {
+	if instance.status == 0 {
+		instance.status = status
+	}
+}
+
+// Fetch the image from the upstream server and store it in the cache (using the same fill path as a cache MISS).
+// Images which are already cached are skipped (fetched = false).
+func (instance *FileCacheHandler) Prefetch(image ImagePath) (fetched bool, size int64, err error) {
+	if _, _, e := instance.find(image.File()); e == nil {
+		return
+	}
+	source, err := instance.fetchUpstream(context.Background(), image.String())
+	if err != nil {
+		return
+	}
+	defer source.Body.Close()
+	response := new(discardResponseWriter)
+	if !instance.cacheFileFromUpstream(source, image.File(), response) {
+		err = fmt.Errorf("image was not cached (upstream server responded with status %d)", response.status)
+		return
+	}
+	instance.recordChapterImage(image)
+	fetched, size = true, response.size
+	return
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mdath/log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type VerifyAction int
+
+const (
+	// only report corrupted images
+	VerifyOnly VerifyAction = 0
+	// move corrupted images into the quarantine directory
+	VerifyQuarantine VerifyAction = 1
+	// delete corrupted images
+	VerifyDelete VerifyAction = 2
+
+	// default age below which images are not verified by the background scrubber (they might still be filled from the upstream server)
+	VerifyMinAge = 5 * time.Minute
+)
+
+type VerifyOptions struct {
+	Action     VerifyAction
+	Quarantine string        // directory for quarantined images (required for VerifyQuarantine)
+	Throttle   time.Duration // pause between two verified images (e.g. for a low priority background scrub)
+	MinAge     time.Duration // images which were modified more recently are skipped
+	Progress   func(report VerifyReport)
+}
+
+type VerifyReport struct {
+	Checked     int64            `json:"checked"`
+	Bytes       int64            `json:"bytes"`
+	Corrupted   int64            `json:"corrupted"`
+	Quarantined int64            `json:"quarantined"`
+	Deleted     int64            `json:"deleted"`
+	Reasons     map[string]int64 `json:"reasons"`
+}
+
+var magicBytes = map[string][][]byte{
+	".png":  {[]byte("\x89PNG\r\n\x1a\n")},
+	".jpg":  {[]byte("\xff\xd8\xff")},
+	".jpeg": {[]byte("\xff\xd8\xff")},
+	".gif":  {[]byte("GIF87a"), []byte("GIF89a")},
+	".webp": {[]byte("RIFF")},
+}
+
+// Verify that the header of the image matches the signature of the given file extension.
+func matchMagicBytes(extension string, header []byte) bool {
+	signatures, ok := magicBytes[extension]
+	if !ok {
+		return false
+	}
+	if extension == ".webp" && (len(header) < 12 || !bytes.Equal(header[8:12], []byte("WEBP"))) {
+		return false
+	}
+	for _, signature := range signatures {
+		if bytes.HasPrefix(header, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify a cached image against its key in the cache layout.
+// The layout only preserves the first four and the last eight characters of the SHA-256 hash, which are compared with the hash of the content.
+func verifyCacheImage(storage CacheStorage, key string) (size int64, err error) {
+	segments := strings.Split(key, "/")
+	if len(segments) != 3 || len(segments[0]) != 2 || len(segments[1]) != 2 {
+		err = errors.New("unexpected location")
+		return
+	}
+	extension := path.Ext(segments[2])
+	suffix := strings.TrimSuffix(segments[2], extension)
+
+	file, _, err := storage.Get(key)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	header := make([]byte, 12)
+	n, _ := io.ReadFull(file, header)
+	if n == 0 {
+		err = errors.New("empty file")
+		return
+	}
+	if !matchMagicBytes(extension, header[:n]) {
+		err = errors.New("magic bytes mismatch")
+		return
+	}
+	hash := sha256.New()
+	hash.Write(header[:n])
+	copied, err := io.Copy(hash, file)
+	if err != nil {
+		return
+	}
+	size = int64(n) + copied
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(checksum[0:4], segments[0]+segments[1]) || !strings.EqualFold(checksum[56:], suffix) {
+		err = errors.New("checksum mismatch")
+		return
+	}
+	return
+}
+
+// Walk all images in the cache roots, verify their content and handle corrupted images according to the given options.
+func (instance *FileCacheHandler) Verify(options VerifyOptions) (report VerifyReport, err error) {
+	report.Reasons = make(map[string]int64)
+	if options.Action == VerifyQuarantine {
+		err = os.MkdirAll(options.Quarantine, 0755)
+		if err != nil {
+			return
+		}
+	}
+	for _, root := range instance.allRoots() {
+		if !root.available() {
+			continue
+		}
+		err = root.Storage.Walk("", func(key string, info StorageInfo) error {
+			if time.Since(info.Modified) < options.MinAge {
+				return nil
+			}
+			size, failure := verifyCacheImage(root.Storage, key)
+			report.Checked++
+			report.Bytes += size
+			if failure != nil {
+				report.Corrupted++
+				report.Reasons[failure.Error()]++
+				instance.handleCorruptedImage(root, key, failure, options, &report)
+			}
+			if options.Progress != nil && report.Checked%1000 == 0 {
+				options.Progress(report)
+			}
+			if options.Throttle > 0 {
+				time.Sleep(options.Throttle)
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (instance *FileCacheHandler) handleCorruptedImage(root *cacheRoot, key string, failure error, options VerifyOptions, report *VerifyReport) {
+	location := root.location(key)
+	info, err := root.Storage.Stat(key)
+	if err != nil {
+		return
+	}
+	switch options.Action {
+	case VerifyQuarantine:
+		destination := filepath.Join(options.Quarantine, strings.ReplaceAll(key, "/", "_"))
+		if err := quarantineCacheImage(root.Storage, key, destination); err != nil {
+			log.Warn("Failed to quarantine corrupted image", location, err)
+			return
+		}
+		root.account(-info.Size)
+		instance.forget(key)
+		report.Quarantined++
+		log.Warn("Quarantined corrupted image", location, "("+failure.Error()+")")
+	case VerifyDelete:
+		if err := root.Storage.Delete(key); err != nil {
+			log.Warn("Failed to delete corrupted image", location, err)
+			return
+		}
+		root.account(-info.Size)
+		instance.forget(key)
+		report.Deleted++
+		log.Warn("Deleted corrupted image", location, "("+failure.Error()+")")
+	default:
+		log.Warn("Found corrupted image", location, "("+failure.Error()+")")
+	}
+}
+
+// Move the image out of the storage into the quarantine directory.
+func quarantineCacheImage(storage CacheStorage, key string, destination string) (err error) {
+	if directory, ok := storage.(*DirectoryStorage); ok && os.Rename(directory.Location(key), destination) == nil {
+		directory.invalidate(key)
+		return
+	}
+	reader, _, err := storage.Get(key)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	output, err := os.Create(destination)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(output, reader)
+	if e := output.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = storage.Delete(key)
+	}
+	return
+}
+
+// Periodically verify the whole cache in the background with a pause between two images, so regular requests are not affected.
+func (instance *FileCacheHandler) StartScrubber(interval time.Duration, options VerifyOptions) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			log.Info("Started background verification of the cache")
+			report, err := instance.Verify(options)
+			if err != nil {
+				log.Warn("Background verification of the cache failed", err)
+				continue
+			}
+			log.Info("Finished background verification of the cache:", report.Checked, "images checked,", report.Corrupted, "corrupted")
+		}
+	}()
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mdath/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// directory (inside the primary cache root) containing the metadata of each image received from the upstream server
+	metadataDirectory string = "metadata"
+	// max. number of metadata entries kept in memory for serving hot images
+	metadataCacheSize int = 16384
+)
+
+// Details of the upstream response an image was cached from.
+type ImageMetadata struct {
+	Upstream string      `json:"upstream"` // URL of the image on the upstream server
+	Fetched  time.Time   `json:"fetched"`
+	Size     int64       `json:"size"`
+	SHA256   string      `json:"sha256"` // checksum of the received image
+	Header   http.Header `json:"header"` // headers of the upstream response (without hop-by-hop headers)
+}
+
+func metadataLocation(directory string, key string) string {
+	return filepath.Join(directory, metadataDirectory, filepath.FromSlash(key)+".json")
+}
+
+type metadataEntry struct {
+	key      string
+	metadata *ImageMetadata // nil if the image has no metadata
+}
+
+// Recently used metadata (including the absence of metadata), so hot images are served without reading their metadata again.
+type metadataCache struct {
+	entries map[string]*list.Element
+	recency *list.List // most recently used at the front
+	mutex   sync.Mutex
+}
+
+func (instance *metadataCache) get(key string) (metadata *ImageMetadata, ok bool) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	element, ok := instance.entries[key]
+	if !ok {
+		return
+	}
+	instance.recency.MoveToFront(element)
+	return element.Value.(*metadataEntry).metadata, true
+}
+
+func (instance *metadataCache) put(key string, metadata *ImageMetadata) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if instance.entries == nil {
+		instance.entries = make(map[string]*list.Element)
+		instance.recency = list.New()
+	}
+	if element, ok := instance.entries[key]; ok {
+		element.Value.(*metadataEntry).metadata = metadata
+		instance.recency.MoveToFront(element)
+		return
+	}
+	instance.entries[key] = instance.recency.PushFront(&metadataEntry{key, metadata})
+	for len(instance.entries) > metadataCacheSize {
+		entry := instance.recency.Remove(instance.recency.Back()).(*metadataEntry)
+		delete(instance.entries, entry.key)
+	}
+}
+
+func (instance *metadataCache) remove(key string) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if element, ok := instance.entries[key]; ok {
+		instance.recency.Remove(element)
+		delete(instance.entries, key)
+	}
+}
+
+// Persist the metadata of a cached image as sidecar in the primary root (metadata is only kept if a root is on the local file system).
+func (instance *FileCacheHandler) storeMetadata(key string, metadata *ImageMetadata) {
+	primary := instance.primary()
+	if primary == nil {
+		return
+	}
+	instance.metadata.put(key, metadata)
+	location := metadataLocation(primary.Directory, key)
+	data, err := json.Marshal(metadata)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(location), 0755)
+	}
+	if err == nil {
+		err = writeFileAtomically(location, data)
+	}
+	if err != nil {
+		log.Warn("Failed to store image metadata", err)
+	}
+}
+
+// Write the data into a temporary file next to the location first, so concurrent writers never interleave and readers never see partial data.
+func writeFileAtomically(location string, data []byte) (err error) {
+	output, err := os.CreateTemp(filepath.Dir(location), ".meta-*")
+	if err != nil {
+		return
+	}
+	_, err = output.Write(data)
+	if e := output.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(output.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(output.Name(), location)
+	}
+	if err != nil {
+		os.Remove(output.Name())
+	}
+	return
+}
+
+// Provide the metadata of a cached image (nil if it's not known, e.g. for imported images).
+func (instance *FileCacheHandler) loadMetadata(key string) *ImageMetadata {
+	if metadata, ok := instance.metadata.get(key); ok {
+		return metadata
+	}
+	primary := instance.primary()
+	if primary == nil {
+		return nil
+	}
+	var metadata *ImageMetadata
+	data, err := os.ReadFile(metadataLocation(primary.Directory, key))
+	if err == nil {
+		metadata = new(ImageMetadata)
+		if err = json.Unmarshal(data, metadata); err != nil {
+			log.Warn("Failed to read image metadata", key, err)
+			metadata = nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Warn("Failed to read image metadata", err)
+	}
+	instance.metadata.put(key, metadata)
+	return metadata
+}
+
+func (instance *FileCacheHandler) removeMetadata(key string) {
+	instance.metadata.remove(key)
+	if primary := instance.primary(); primary != nil {
+		os.Remove(metadataLocation(primary.Directory, key))
+	}
+}
+
+// Write the headers of a cached image including its metadata, reports whether the client's copy is still valid (the response is complete then).
+func (instance *FileCacheHandler) writeCachedHeaders(key string, size int64, response http.ResponseWriter, request *http.Request) (notModified bool) {
+	writeImageHeaders(key, size, response)
+	metadata := instance.loadMetadata(key)
+	if metadata == nil {
+		return
+	}
+	etag, modified := writeMetadataHeaders(metadata, response)
+	if match := request.Header.Get("If-None-Match"); match != "" {
+		notModified = etag != "" && matchesETag(match, etag)
+	} else if since, err := http.ParseTime(request.Header.Get("If-Modified-Since")); err == nil {
+		notModified = !modified.Truncate(time.Second).After(since)
+	}
+	if notModified {
+		response.Header().Del("Content-Length")
+		response.Header().Del("Content-Type")
+		response.WriteHeader(http.StatusNotModified)
+	}
+	return
+}
+
+// Replace the generic headers of an image with the headers of the upstream server (the checksum is used as entity tag if the upstream server provided none).
+func writeMetadataHeaders(metadata *ImageMetadata, response http.ResponseWriter) (etag string, modified time.Time) {
+	header := response.Header()
+	if contentType := metadata.Header.Get("Content-Type"); strings.HasPrefix(contentType, "image/") {
+		header.Set("Content-Type", contentType)
+	}
+	etag = metadata.Header.Get("ETag")
+	if etag == "" && metadata.SHA256 != "" {
+		etag = `"` + metadata.SHA256 + `"`
+	}
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	modified, err := http.ParseTime(metadata.Header.Get("Last-Modified"))
+	if err != nil {
+		modified = metadata.Fetched
+	}
+	header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	return
+}
+
+// Weak comparison of the entity tags of an If-None-Match header with the given entity tag.
+func matchesETag(match string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(match, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
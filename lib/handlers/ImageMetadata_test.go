@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentMetadataWrites(t *testing.T) {
+	directory := t.TempDir()
+	cache := CreateFileCacheHandler([]CacheRoot{{Directory: directory, Limit: 1 << 20}}, nil, nil)
+	key := "ab/cd/12345678.png"
+
+	var group sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			cache.storeMetadata(key, &ImageMetadata{Upstream: "https://upstream.example.com/" + strconv.Itoa(i), Size: int64(i)})
+		}(i)
+	}
+	group.Wait()
+
+	location := metadataLocation(directory, key)
+	data, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata ImageMetadata
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("interleaved metadata %q: %v", data, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("temporary files left behind:", len(entries), "files")
+	}
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sketchDepth       int   = 4
+	sketchMaxCount    uint8 = 15
+	sketchMinWidth    int   = 4096
+	sketchAverageSize int64 = 16 * 1024
+)
+
+// Approximate access frequencies of keys (count-min sketch with 4-bit saturation and periodic aging).
+type frequencySketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func createFrequencySketch(capacity int64) *frequencySketch {
+	width := sketchMinWidth
+	for int64(width)*sketchAverageSize < capacity {
+		width <<= 1
+	}
+	instance := &frequencySketch{
+		mask:    uint64(width - 1),
+		resetAt: 10 * width,
+	}
+	for i := range instance.rows {
+		instance.rows[i] = make([]uint8, width)
+	}
+	return instance
+}
+
+func (instance *frequencySketch) indexes(key string) (indexes [sketchDepth]uint64) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	low, high := sum&0xFFFFFFFF, sum>>32
+	for i := range indexes {
+		indexes[i] = (low + uint64(i)*high) & instance.mask
+	}
+	return
+}
+
+func (instance *frequencySketch) increment(key string) {
+	for row, index := range instance.indexes(key) {
+		if instance.rows[row][index] < sketchMaxCount {
+			instance.rows[row][index]++
+		}
+	}
+	instance.additions++
+	if instance.additions >= instance.resetAt {
+		// halve all counters, so old popularity fades out
+		for row := range instance.rows {
+			for index := range instance.rows[row] {
+				instance.rows[row][index] >>= 1
+			}
+		}
+		instance.additions /= 2
+	}
+}
+
+func (instance *frequencySketch) estimate(key string) (count uint8) {
+	count = sketchMaxCount
+	for row, index := range instance.indexes(key) {
+		if instance.rows[row][index] < count {
+			count = instance.rows[row][index]
+		}
+	}
+	return
+}
+
+type memoryEntry struct {
+	key      string
+	data     []byte
+	modified time.Time
+}
+
+type MemoryCacheStatistics struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+	Admitted int64   `json:"admitted"`
+	Rejected int64   `json:"rejected"`
+	Items    int     `json:"items"`
+	Bytes    int64   `json:"bytes"`
+	Capacity int64   `json:"capacity"`
+}
+
+// Size limited in-memory cache for the hottest images.
+// New images are only admitted when they are accessed more frequently than the images they would evict (TinyLFU).
+type MemoryCache struct {
+	capacity  int64
+	maxObject int64
+	size      int64
+	items     map[string]*list.Element
+	recency   *list.List // most recently used at the front
+	sketch    *frequencySketch
+	mutex     sync.Mutex
+	hits      int64
+	misses    int64
+	admitted  int64
+	rejected  int64
+}
+
+// Instantiate a new MemoryCache holding at most capacity bytes, images larger than maxObject bytes are never admitted.
+func CreateMemoryCache(capacity int64, maxObject int64) *MemoryCache {
+	if maxObject <= 0 || maxObject > capacity {
+		maxObject = capacity
+	}
+	return &MemoryCache{
+		capacity:  capacity,
+		maxObject: maxObject,
+		items:     make(map[string]*list.Element),
+		recency:   list.New(),
+		sketch:    createFrequencySketch(capacity),
+	}
+}
+
+// Provide the cached image and record the access (also for misses, so frequently requested images get admitted).
+func (instance *MemoryCache) Get(key string) (data []byte, modified time.Time, ok bool) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.sketch.increment(key)
+	element, ok := instance.items[key]
+	if !ok {
+		atomic.AddInt64(&instance.misses, 1)
+		return
+	}
+	atomic.AddInt64(&instance.hits, 1)
+	instance.recency.MoveToFront(element)
+	entry := element.Value.(*memoryEntry)
+	return entry.data, entry.modified, true
+}
+
+// Check whether an image of the given size may be offered to the cache at all.
+func (instance *MemoryCache) Accepts(size int64) bool {
+	return size > 0 && size <= instance.maxObject
+}
+
+// Check whether an image of the given size would be admitted right now, so images which would be rejected aren't read into memory at all.
+func (instance *MemoryCache) Admits(key string, size int64) bool {
+	if !instance.Accepts(size) {
+		return false
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	_, admitted := instance.victims(key, size)
+	return admitted
+}
+
+// Offer an image to the cache, which is only admitted if it is accessed more frequently than all images it would evict.
+func (instance *MemoryCache) Offer(key string, data []byte, modified time.Time) (admitted bool) {
+	size := int64(len(data))
+	if !instance.Accepts(size) {
+		return
+	}
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	victims, admitted := instance.victims(key, size)
+	if !admitted {
+		return
+	}
+	for _, element := range victims {
+		instance.evict(element)
+	}
+	instance.items[key] = instance.recency.PushFront(&memoryEntry{key, data, modified})
+	instance.size += size
+	atomic.AddInt64(&instance.admitted, 1)
+	return true
+}
+
+// Select the least recently used images which have to be evicted for the image, which is only admitted if it is accessed more frequently than all of them.
+// Only images which are turned down for their frequency are counted as rejected (images which are cached already are neither admitted nor rejected).
+func (instance *MemoryCache) victims(key string, size int64) (victims []*list.Element, admitted bool) {
+	if _, ok := instance.items[key]; ok {
+		return
+	}
+	frequency := instance.sketch.estimate(key)
+	free := instance.capacity - instance.size
+	for element := instance.recency.Back(); free < size && element != nil; element = element.Prev() {
+		victim := element.Value.(*memoryEntry)
+		if instance.sketch.estimate(victim.key) >= frequency {
+			atomic.AddInt64(&instance.rejected, 1)
+			return nil, false
+		}
+		victims = append(victims, element)
+		free += int64(len(victim.data))
+	}
+	return victims, free >= size
+}
+
+// Remove an image from the cache (e.g. when it was purged from the disk).
+func (instance *MemoryCache) Remove(key string) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if element, ok := instance.items[key]; ok {
+		instance.evict(element)
+	}
+}
+
+func (instance *MemoryCache) evict(element *list.Element) {
+	entry := instance.recency.Remove(element).(*memoryEntry)
+	delete(instance.items, entry.key)
+	instance.size -= int64(len(entry.data))
+}
+
+func (instance *MemoryCache) Statistics() (statistics MemoryCacheStatistics) {
+	instance.mutex.Lock()
+	statistics.Items = len(instance.items)
+	statistics.Bytes = instance.size
+	instance.mutex.Unlock()
+	statistics.Capacity = instance.capacity
+	statistics.Hits = atomic.LoadInt64(&instance.hits)
+	statistics.Misses = atomic.LoadInt64(&instance.misses)
+	statistics.Admitted = atomic.LoadInt64(&instance.admitted)
+	statistics.Rejected = atomic.LoadInt64(&instance.rejected)
+	if total := statistics.Hits + statistics.Misses; total > 0 {
+		statistics.HitRatio = float64(statistics.Hits) / float64(total)
+	}
+	return
+}
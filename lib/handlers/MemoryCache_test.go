@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheAdmitsOnlyMoreFrequentImages(t *testing.T) {
+	cache := CreateMemoryCache(100, 100)
+	cache.Get("popular")
+	cache.Get("popular")
+	if !cache.Admits("popular", 100) || !cache.Offer("popular", make([]byte, 100), time.Now()) {
+		t.Fatal("image not admitted into the empty cache")
+	}
+
+	cache.Get("rare")
+	if cache.Admits("rare", 50) {
+		t.Fatal("rare image admitted in place of a more popular one")
+	}
+	for i := 0; i < 3; i++ {
+		cache.Get("hot")
+	}
+	if !cache.Admits("hot", 50) {
+		t.Fatal("image not admitted in place of a less popular one")
+	}
+	if _, _, ok := cache.Get("popular"); !ok {
+		t.Fatal("checking the admission evicted an image")
+	}
+	if cache.Admits("popular", 100) {
+		t.Fatal("cached image admitted again")
+	}
+}
+
+func TestMemoryCacheCountsEachRejectionOnce(t *testing.T) {
+	cache := CreateMemoryCache(100, 100)
+	cache.Get("popular")
+	cache.Get("popular")
+	if cache.Admits("popular", 100) {
+		cache.Offer("popular", make([]byte, 100), time.Now())
+	}
+	// a cached image is neither admitted nor rejected again
+	cache.Get("popular")
+	if cache.Admits("popular", 100) || cache.Offer("popular", make([]byte, 100), time.Now()) {
+		t.Fatal("cached image admitted again")
+	}
+	// a rare image is rejected once per request
+	cache.Get("rare")
+	if cache.Admits("rare", 50) {
+		cache.Offer("rare", make([]byte, 50), time.Now())
+	}
+	if statistics := cache.Statistics(); statistics.Admitted != 1 || statistics.Rejected != 1 {
+		t.Fatal("unexpected counters:", statistics.Admitted, "admitted and", statistics.Rejected, "rejected")
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errWriterClosed = errors.New("writer was already committed or aborted")
+
+type storedImage struct {
+	data     []byte
+	modified time.Time
+}
+
+// Storage of images in memory (e.g. for tests or a volatile cache), nothing is kept across restarts.
+type MemoryStorage struct {
+	images map[string]storedImage
+	mutex  sync.RWMutex
+}
+
+func CreateMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{images: make(map[string]storedImage)}
+}
+
+func (instance *MemoryStorage) Get(key string) (reader io.ReadCloser, info StorageInfo, err error) {
+	instance.mutex.RLock()
+	image, ok := instance.images[key]
+	instance.mutex.RUnlock()
+	if !ok {
+		err = fs.ErrNotExist
+		return
+	}
+	return io.NopCloser(bytes.NewReader(image.data)), StorageInfo{int64(len(image.data)), image.modified}, nil
+}
+
+func (instance *MemoryStorage) Put(key string) (writer StorageWriter, err error) {
+	return &memoryWriter{storage: instance, key: key}, nil
+}
+
+func (instance *MemoryStorage) Stat(key string) (info StorageInfo, err error) {
+	instance.mutex.RLock()
+	image, ok := instance.images[key]
+	instance.mutex.RUnlock()
+	if !ok {
+		err = fs.ErrNotExist
+		return
+	}
+	return StorageInfo{int64(len(image.data)), image.modified}, nil
+}
+
+func (instance *MemoryStorage) Delete(key string) error {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if _, ok := instance.images[key]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(instance.images, key)
+	return nil
+}
+
+func (instance *MemoryStorage) Walk(prefix string, callback func(key string, info StorageInfo) error) error {
+	// walk a snapshot of the keys, so the callback may modify the storage
+	instance.mutex.RLock()
+	keys := make([]string, 0, len(instance.images))
+	for key := range instance.images {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	instance.mutex.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		info, err := instance.Stat(key)
+		if err != nil {
+			continue
+		}
+		if err = callback(key, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memoryWriter struct {
+	storage *MemoryStorage
+	key     string
+	buffer  bytes.Buffer
+	closed  bool
+}
+
+func (instance *memoryWriter) Write(data []byte) (int, error) {
+	if instance.closed {
+		return 0, errWriterClosed
+	}
+	return instance.buffer.Write(data)
+}
+
+func (instance *memoryWriter) Commit() error {
+	if instance.closed {
+		return errWriterClosed
+	}
+	instance.closed = true
+	instance.storage.mutex.Lock()
+	defer instance.storage.mutex.Unlock()
+	instance.storage.images[instance.key] = storedImage{instance.buffer.Bytes(), time.Now()}
+	return nil
+}
+
+func (instance *memoryWriter) Abort() {
+	instance.closed = true
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// default max. number of missing images which are remembered
+	NegativeCacheSize int = 100000
+	// default time for which a missing image is answered without asking the upstream server again
+	NegativeCacheTTL = 5 * time.Minute
+)
+
+type negativeEntry struct {
+	path    string
+	status  int
+	expires time.Time
+}
+
+type NegativeCacheStatistics struct {
+	Hits     int64 `json:"hits"`
+	Added    int64 `json:"added"`
+	Items    int   `json:"items"`
+	Capacity int   `json:"capacity"`
+}
+
+// Size limited cache of images which the upstream server reported as missing (404 or 410), keyed by the upstream path (chapter and file name).
+// All entries share the same TTL, so the oldest entry is always the next to expire.
+type NegativeCache struct {
+	capacity int
+	ttl      time.Duration
+	items    map[string]*list.Element
+	age      *list.List // oldest at the front
+	mutex    sync.Mutex
+	hits     int64
+	added    int64
+}
+
+// Instantiate a new NegativeCache holding at most capacity images for ttl each.
+func CreateNegativeCache(capacity int, ttl time.Duration) *NegativeCache {
+	return &NegativeCache{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    make(map[string]*list.Element),
+		age:      list.New(),
+	}
+}
+
+// Provide the status the upstream server responded with, if the image is known to be missing.
+func (instance *NegativeCache) Get(path string) (status int, ok bool) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	element, ok := instance.items[path]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*negativeEntry)
+	if time.Now().After(entry.expires) {
+		instance.evict(element)
+		return 0, false
+	}
+	atomic.AddInt64(&instance.hits, 1)
+	return entry.status, true
+}
+
+// Remember that the upstream server responded with the given status for the image.
+func (instance *NegativeCache) Add(path string, status int) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	if element, ok := instance.items[path]; ok {
+		instance.evict(element)
+	}
+	now := time.Now()
+	for element := instance.age.Front(); element != nil; element = instance.age.Front() {
+		if len(instance.items) < instance.capacity && now.Before(element.Value.(*negativeEntry).expires) {
+			break
+		}
+		instance.evict(element)
+	}
+	instance.items[path] = instance.age.PushBack(&negativeEntry{path, status, now.Add(instance.ttl)})
+	atomic.AddInt64(&instance.added, 1)
+}
+
+func (instance *NegativeCache) evict(element *list.Element) {
+	entry := instance.age.Remove(element).(*negativeEntry)
+	delete(instance.items, entry.path)
+}
+
+func (instance *NegativeCache) Statistics() (statistics NegativeCacheStatistics) {
+	instance.mutex.Lock()
+	statistics.Items = len(instance.items)
+	instance.mutex.Unlock()
+	statistics.Capacity = instance.capacity
+	statistics.Hits = atomic.LoadInt64(&instance.hits)
+	statistics.Added = atomic.LoadInt64(&instance.added)
+	return
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNegativeCacheIsScopedToThePath(t *testing.T) {
+	cache := CreateNegativeCache(10, time.Minute)
+	hash := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	cache.Add("/data/ffffffffffffffffffffffffffffffff/x1-"+hash+".png", http.StatusNotFound)
+
+	if status, ok := cache.Get("/data/ffffffffffffffffffffffffffffffff/x1-" + hash + ".png"); !ok || status != http.StatusNotFound {
+		t.Fatal("missing image not remembered:", status, ok)
+	}
+	if _, ok := cache.Get("/data/0123456789abcdef0123456789abcdef/x1-" + hash + ".png"); ok {
+		t.Fatal("missing image in one chapter blocks the same hash in another chapter")
+	}
+}
+
+func TestNegativeCacheExpiresAndEvicts(t *testing.T) {
+	cache := CreateNegativeCache(2, 20*time.Millisecond)
+	cache.Add("/a", http.StatusNotFound)
+	cache.Add("/b", http.StatusGone)
+	cache.Add("/c", http.StatusNotFound)
+	if _, ok := cache.Get("/a"); ok {
+		t.Fatal("oldest entry not evicted at capacity")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := cache.Get("/b"); ok {
+		t.Fatal("entry not expired after the TTL")
+	}
+}
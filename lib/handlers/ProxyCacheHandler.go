@@ -10,6 +10,8 @@ import (
 type ProxyCacheHandler struct {
 	origins   []string
 	validator *mdath.RequestValidator
+	client    *mdath.UpstreamClient
+	signer    *mdath.RequestSigner
 }
 
 func CreateProxyCacheHandler(origins []string, validator *mdath.RequestValidator) (instance *ProxyCacheHandler) {
@@ -20,9 +22,20 @@ func CreateProxyCacheHandler(origins []string, validator *mdath.RequestValidator
 	return &ProxyCacheHandler{
 		origins:   origins,
 		validator: validator,
+		client:    mdath.CreateUpstreamClient(mdath.UpstreamClientOptions{Retries: mdath.RequestRetries}),
 	}
 }
 
+// Replace the client (with the default options) which is used for requests to the origins.
+func (instance *ProxyCacheHandler) UseUpstreamClient(client *mdath.UpstreamClient) {
+	instance.client = client
+}
+
+// Sign all requests to the origins, so cache nodes requiring a signature accept them.
+func (instance *ProxyCacheHandler) SignRequests(signer *mdath.RequestSigner) {
+	instance.signer = signer
+}
+
 func (instance *ProxyCacheHandler) ServeHTTP(destination http.ResponseWriter, request *http.Request) {
 	path, _, err := instance.validator.ExtractValidatedPath(request)
 	if err != nil {
@@ -35,7 +48,16 @@ func (instance *ProxyCacheHandler) ServeHTTP(destination http.ResponseWriter, re
 
 	// TODO: get origin from list (random, round robin, ...)
 	url := instance.origins[0] + path
-	source, err := http.Get(url)
+	forward, err := http.NewRequestWithContext(request.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		log.Warn("Failed to create request to upstream server", err)
+		destination.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if instance.signer != nil {
+		instance.signer.Sign(forward)
+	}
+	source, err := instance.client.Do(forward)
 	if err != nil {
 		log.Warn("Failed to receive image from upstream server", err)
 		destination.WriteHeader(http.StatusBadGateway)
@@ -43,11 +65,7 @@ func (instance *ProxyCacheHandler) ServeHTTP(destination http.ResponseWriter, re
 	}
 	defer source.Body.Close()
 
-	for key, values := range source.Header {
-		for _, value := range values {
-			destination.Header().Add(key, value)
-		}
-	}
+	copyUpstreamHeaders(source.Header, destination.Header())
 	destination.WriteHeader(source.StatusCode)
 	io.Copy(destination, source.Body)
 	log.Verbose("Response (Proxied):", request.RemoteAddr, "<=", url)
@@ -0,0 +1,368 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	mdath "mdath/lib"
+	"mdath/log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3Algorithm      string = "AWS4-HMAC-SHA256"
+	s3DefaultRegion  string = "us-east-1"
+	s3SignedHeaders  string = "host;x-amz-content-sha256;x-amz-date"
+	s3ListBatch      string = "1000"
+	s3RefreshBackoff        = 1 * time.Minute
+)
+
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com or http://127.0.0.1:9000 (buckets are addressed path-style)
+	Region    string // defaults to us-east-1
+	Bucket    string
+	Prefix    string // prepended to the key of each image (e.g. cheetah/)
+	AccessKey string
+	SecretKey string
+	Client    *mdath.UpstreamClient // defaults to a client with the default options
+}
+
+// Storage of images in an S3 compatible bucket.
+// Existence checks and listings are answered from an in-memory index of the bucket, which is loaded once in the background (HEAD requests are used until then).
+type S3Storage struct {
+	config  S3Config
+	client  *mdath.UpstreamClient
+	index   map[string]StorageInfo
+	indexed bool
+	mutex   sync.RWMutex
+	listing sync.Mutex
+}
+
+func CreateS3Storage(config S3Config) (instance *S3Storage) {
+	if config.Region == "" {
+		config.Region = s3DefaultRegion
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	if config.Client == nil {
+		config.Client = mdath.CreateUpstreamClient(mdath.UpstreamClientOptions{Retries: mdath.RequestRetries})
+	}
+	instance = &S3Storage{
+		config: config,
+		client: config.Client,
+		index:  make(map[string]StorageInfo),
+	}
+	go func() {
+		for instance.refresh() != nil {
+			time.Sleep(s3RefreshBackoff)
+		}
+	}()
+	return
+}
+
+func (instance *S3Storage) Get(key string) (reader io.ReadCloser, info StorageInfo, err error) {
+	response, err := instance.request(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return
+	}
+	if err = instance.check(response, key); err != nil {
+		response.Body.Close()
+		return
+	}
+	info.Size = response.ContentLength
+	info.Modified, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+	return response.Body, info, nil
+}
+
+func (instance *S3Storage) Put(key string) (writer StorageWriter, err error) {
+	return &s3Writer{storage: instance, key: key}, nil
+}
+
+func (instance *S3Storage) Stat(key string) (info StorageInfo, err error) {
+	instance.mutex.RLock()
+	info, ok := instance.index[key]
+	indexed := instance.indexed
+	instance.mutex.RUnlock()
+	if ok {
+		return
+	}
+	if indexed {
+		err = fs.ErrNotExist
+		return
+	}
+	response, err := instance.request(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	if err = instance.check(response, key); err != nil {
+		return
+	}
+	info.Size = response.ContentLength
+	info.Modified, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+	instance.remember(key, info)
+	return
+}
+
+func (instance *S3Storage) Delete(key string) (err error) {
+	response, err := instance.request(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	if err = instance.check(response, key); err != nil {
+		return
+	}
+	instance.forget(key)
+	return
+}
+
+func (instance *S3Storage) Walk(prefix string, callback func(key string, info StorageInfo) error) error {
+	if err := instance.refresh(); err != nil {
+		return err
+	}
+	// walk a snapshot of the index, so the callback may modify the storage
+	instance.mutex.RLock()
+	keys := make([]string, 0, len(instance.index))
+	for key := range instance.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	instance.mutex.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		instance.mutex.RLock()
+		info, ok := instance.index[key]
+		instance.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := callback(key, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify that the bucket is reachable with the configured credentials (a lazy Put can't detect an unavailable bucket).
+func (instance *S3Storage) Check() (err error) {
+	response, err := instance.request(http.MethodGet, "", map[string]string{"list-type": "2", "max-keys": "1"}, nil)
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	return instance.check(response, "")
+}
+
+// Load the index from a listing of the bucket (only once, images stored in the meantime are kept).
+func (instance *S3Storage) refresh() (err error) {
+	instance.listing.Lock()
+	defer instance.listing.Unlock()
+	instance.mutex.RLock()
+	indexed := instance.indexed
+	instance.mutex.RUnlock()
+	if indexed {
+		return
+	}
+	started := time.Now()
+	listed := make(map[string]StorageInfo)
+	query := map[string]string{"list-type": "2", "max-keys": s3ListBatch, "prefix": instance.config.Prefix}
+	for {
+		var result s3ListResult
+		if result, err = instance.list(query); err != nil {
+			log.Warn("Failed to list S3 bucket", instance.config.Bucket, err)
+			return
+		}
+		for _, object := range result.Contents {
+			key := strings.TrimPrefix(object.Key, instance.config.Prefix)
+			if strings.Count(key, "/") == 2 {
+				listed[key] = StorageInfo{object.Size, object.LastModified}
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query["continuation-token"] = result.NextContinuationToken
+	}
+	instance.mutex.Lock()
+	for key, info := range instance.index {
+		listed[key] = info
+	}
+	instance.index = listed
+	instance.indexed = true
+	instance.mutex.Unlock()
+	log.Info("Loaded index of S3 bucket", instance.config.Bucket+":", len(listed), "images in", time.Since(started).Round(time.Millisecond))
+	return
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (instance *S3Storage) list(query map[string]string) (result s3ListResult, err error) {
+	response, err := instance.request(http.MethodGet, "", query, nil)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if err = instance.check(response, ""); err != nil {
+		return
+	}
+	err = xml.NewDecoder(response.Body).Decode(&result)
+	return
+}
+
+func (instance *S3Storage) remember(key string, info StorageInfo) {
+	instance.mutex.Lock()
+	instance.index[key] = info
+	instance.mutex.Unlock()
+}
+
+func (instance *S3Storage) forget(key string) {
+	instance.mutex.Lock()
+	delete(instance.index, key)
+	instance.mutex.Unlock()
+}
+
+// Map the status of the response to an error (missing objects are reported with fs.ErrNotExist and dropped from the index).
+func (instance *S3Storage) check(response *http.Response, key string) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	if response.StatusCode == http.StatusNotFound && key != "" {
+		instance.forget(key)
+		return fs.ErrNotExist
+	}
+	return fmt.Errorf("s3 %s %s responded with status %d", response.Request.Method, response.Request.URL.Path, response.StatusCode)
+}
+
+// Send a request for the given key (or the bucket itself if the key is empty) signed with AWS signature version 4.
+func (instance *S3Storage) request(method string, key string, query map[string]string, body []byte) (response *http.Response, err error) {
+	path := "/" + s3Escape(instance.config.Bucket, false) + "/"
+	if key != "" {
+		path += s3Escape(instance.config.Prefix+key, true)
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parameters := make([]string, 0, len(names))
+	for _, name := range names {
+		parameters = append(parameters, s3Escape(name, false)+"="+s3Escape(query[name], false))
+	}
+	canonicalQuery := strings.Join(parameters, "&")
+	target := instance.config.Endpoint + path
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	request.ContentLength = int64(len(body))
+	if body == nil {
+		request.Body = http.NoBody
+	}
+
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	now := time.Now().UTC()
+	timestamp := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", timestamp)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery,
+		"host:" + request.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + timestamp + "\n",
+		s3SignedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + instance.config.Region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	signingKey := s3HMAC([]byte("AWS4"+instance.config.SecretKey), date)
+	signingKey = s3HMAC(signingKey, instance.config.Region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+	request.Header.Set("Authorization", s3Algorithm+" Credential="+instance.config.AccessKey+"/"+scope+", SignedHeaders="+s3SignedHeaders+", Signature="+signature)
+
+	return instance.client.Do(request)
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI encoding as required for the canonical request (only unreserved characters are kept, slashes optionally).
+func s3Escape(value string, slashes bool) string {
+	var builder strings.Builder
+	for _, character := range []byte(value) {
+		switch {
+		case 'a' <= character && character <= 'z', 'A' <= character && character <= 'Z', '0' <= character && character <= '9',
+			character == '-', character == '_', character == '.', character == '~', slashes && character == '/':
+			builder.WriteByte(character)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", character)
+		}
+	}
+	return builder.String()
+}
+
+// Images are buffered in memory and uploaded on commit, as S3 requires the size of an object upfront.
+type s3Writer struct {
+	storage *S3Storage
+	key     string
+	buffer  bytes.Buffer
+	closed  bool
+}
+
+func (instance *s3Writer) Write(data []byte) (int, error) {
+	if instance.closed {
+		return 0, errWriterClosed
+	}
+	return instance.buffer.Write(data)
+}
+
+func (instance *s3Writer) Commit() (err error) {
+	if instance.closed {
+		return errWriterClosed
+	}
+	instance.closed = true
+	response, err := instance.storage.request(http.MethodPut, instance.key, nil, instance.buffer.Bytes())
+	if err != nil {
+		return
+	}
+	response.Body.Close()
+	if err = instance.storage.check(response, ""); err != nil {
+		return
+	}
+	instance.storage.remember(instance.key, StorageInfo{int64(instance.buffer.Len()), time.Now()})
+	return
+}
+
+func (instance *s3Writer) Abort() {
+	instance.closed = true
+}
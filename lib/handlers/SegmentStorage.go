@@ -0,0 +1,548 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"mdath/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// max. size of a segment file before a new one is started
+	SegmentSize int64 = 1 << 30
+	// interval for compacting segments and the index log in the background
+	CompactInterval = 1 * time.Minute
+
+	// sealed segments are compacted when less than this fraction of their bytes belongs to live images
+	compactRatio float64 = 0.5
+	// the index log is rewritten when it contains more than this many entries per live image (plus a constant margin)
+	indexLogRatio  int64 = 2
+	indexLogMargin int64 = 100000
+
+	indexLogFile      string = "index.log"
+	segmentFilePrefix string = "segment-"
+	segmentFileSuffix string = ".dat"
+
+	indexOperationPut    byte = 1
+	indexOperationDelete byte = 2
+	// operation, key length, segment, offset, size, modification time, checksum
+	indexEntryHeader int = 1 + 1 + 4 + 8 + 4 + 8 + 4
+)
+
+type segmentEntry struct {
+	segment  uint32
+	offset   int64
+	size     int64
+	modified int64
+}
+
+type segment struct {
+	id      uint32
+	file    *os.File
+	size    int64 // bytes written (including images which were overwritten or deleted)
+	live    int64 // bytes of images referenced by the index
+	refs    int32
+	retired bool
+	mutex   sync.Mutex
+}
+
+func (instance *segment) acquire() {
+	instance.mutex.Lock()
+	instance.refs++
+	instance.mutex.Unlock()
+}
+
+func (instance *segment) release() {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.refs--
+	if instance.retired && instance.refs == 0 {
+		instance.file.Close()
+	}
+}
+
+// Close the segment once it's no longer read.
+func (instance *segment) retire() {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	instance.retired = true
+	if instance.refs == 0 {
+		instance.file.Close()
+	}
+}
+
+// Storage of images packed into large segment files (avoids millions of small files on large caches).
+// Images are appended to the active segment and located by an in-memory index, which is persisted as an append-only log and replayed on start.
+// Segments are compacted in the background when most of their images were deleted or overwritten.
+type SegmentStorage struct {
+	directory  string
+	index      map[string]segmentEntry
+	segments   map[uint32]*segment
+	active     *segment
+	log        *os.File
+	logEntries int64
+	rewriting  bool     // the index log is rewritten in the background
+	logTail    [][]byte // entries written to the index log since its rewrite started
+	mutex      sync.RWMutex
+}
+
+// Open the segment storage in the given directory (the index log is replayed, so this may take a while for large caches).
+func CreateSegmentStorage(directory string) (instance *SegmentStorage, err error) {
+	if err = os.MkdirAll(directory, 0755); err != nil {
+		return
+	}
+	instance = &SegmentStorage{
+		directory: directory,
+		index:     make(map[string]segmentEntry),
+		segments:  make(map[uint32]*segment),
+	}
+	if err = instance.openSegments(); err != nil {
+		return
+	}
+	if err = instance.replay(); err != nil {
+		return
+	}
+	go func() {
+		for range time.Tick(CompactInterval) {
+			instance.compact()
+		}
+	}()
+	return
+}
+
+func (instance *SegmentStorage) segmentLocation(id uint32) string {
+	return filepath.Join(instance.directory, fmt.Sprintf("%s%08d%s", segmentFilePrefix, id, segmentFileSuffix))
+}
+
+func (instance *SegmentStorage) openSegments() (err error) {
+	entries, err := os.ReadDir(instance.directory)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		var id uint32
+		if !strings.HasPrefix(entry.Name(), segmentFilePrefix) || !strings.HasSuffix(entry.Name(), segmentFileSuffix) {
+			continue
+		}
+		if _, e := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(entry.Name(), segmentFilePrefix), segmentFileSuffix), "%d", &id); e != nil {
+			continue
+		}
+		file, e := os.OpenFile(instance.segmentLocation(id), os.O_RDWR, 0644)
+		if e != nil {
+			return e
+		}
+		info, e := file.Stat()
+		if e != nil {
+			file.Close()
+			return e
+		}
+		current := &segment{id: id, file: file, size: info.Size()}
+		instance.segments[id] = current
+		if instance.active == nil || id > instance.active.id {
+			instance.active = current
+		}
+	}
+	if instance.active == nil {
+		return instance.rotate()
+	}
+	return
+}
+
+// Start a new active segment.
+func (instance *SegmentStorage) rotate() (err error) {
+	var id uint32 = 1
+	if instance.active != nil {
+		instance.active.file.Sync()
+		id = instance.active.id + 1
+	}
+	file, err := os.OpenFile(instance.segmentLocation(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+	instance.active = &segment{id: id, file: file}
+	instance.segments[id] = instance.active
+	return
+}
+
+// Rebuild the index from the index log (a torn entry at the end, e.g. after a crash, is truncated).
+func (instance *SegmentStorage) replay() (err error) {
+	instance.log, err = os.OpenFile(filepath.Join(instance.directory, indexLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	reader := bufio.NewReaderSize(instance.log, 1024*1024)
+	var valid int64
+	header := make([]byte, indexEntryHeader)
+	for {
+		if _, e := io.ReadFull(reader, header); e != nil {
+			break
+		}
+		key := make([]byte, header[1])
+		if _, e := io.ReadFull(reader, key); e != nil {
+			break
+		}
+		checksum := crc32.NewIEEE()
+		checksum.Write(header[:indexEntryHeader-4])
+		checksum.Write(key)
+		if checksum.Sum32() != binary.LittleEndian.Uint32(header[indexEntryHeader-4:]) {
+			break
+		}
+		valid += int64(indexEntryHeader + len(key))
+		instance.logEntries++
+		switch header[0] {
+		case indexOperationPut:
+			instance.index[string(key)] = segmentEntry{
+				segment:  binary.LittleEndian.Uint32(header[2:6]),
+				offset:   int64(binary.LittleEndian.Uint64(header[6:14])),
+				size:     int64(binary.LittleEndian.Uint32(header[14:18])),
+				modified: int64(binary.LittleEndian.Uint64(header[18:26])),
+			}
+		case indexOperationDelete:
+			delete(instance.index, string(key))
+		}
+	}
+	if err = instance.log.Truncate(valid); err != nil {
+		return
+	}
+	if _, err = instance.log.Seek(valid, io.SeekStart); err != nil {
+		return
+	}
+	for key, entry := range instance.index {
+		current, ok := instance.segments[entry.segment]
+		if !ok || entry.offset+entry.size > current.size {
+			log.Warn("Dropped image with missing data from segment storage", instance.directory, key)
+			delete(instance.index, key)
+			continue
+		}
+		current.live += entry.size
+	}
+	log.Info("Opened segment storage", instance.directory+":", len(instance.index), "images in", len(instance.segments), "segments")
+	return
+}
+
+func encodeIndexEntry(operation byte, key string, entry segmentEntry) []byte {
+	data := make([]byte, indexEntryHeader+len(key))
+	data[0] = operation
+	data[1] = byte(len(key))
+	binary.LittleEndian.PutUint32(data[2:6], entry.segment)
+	binary.LittleEndian.PutUint64(data[6:14], uint64(entry.offset))
+	binary.LittleEndian.PutUint32(data[14:18], uint32(entry.size))
+	binary.LittleEndian.PutUint64(data[18:26], uint64(entry.modified))
+	copy(data[indexEntryHeader:], key)
+	checksum := crc32.NewIEEE()
+	checksum.Write(data[:indexEntryHeader-4])
+	checksum.Write(data[indexEntryHeader:])
+	binary.LittleEndian.PutUint32(data[indexEntryHeader-4:indexEntryHeader], checksum.Sum32())
+	return data
+}
+
+// Append the entry to the index log (the caller must hold the lock).
+func (instance *SegmentStorage) writeLog(data []byte) (err error) {
+	if _, err = instance.log.Write(data); err != nil {
+		return
+	}
+	instance.logEntries++
+	if instance.rewriting {
+		instance.logTail = append(instance.logTail, data)
+	}
+	return
+}
+
+// The disk space occupied by the segment files, including the space of deleted images until their segment is compacted.
+func (instance *SegmentStorage) Usage() (usage int64) {
+	instance.mutex.RLock()
+	defer instance.mutex.RUnlock()
+	for _, current := range instance.segments {
+		usage += current.size
+	}
+	return
+}
+
+// Append the image to the active segment and record it in the index (the caller must hold the lock).
+func (instance *SegmentStorage) append(key string, data []byte, modified int64) (err error) {
+	if len(key) > 255 || int64(len(data)) > SegmentSize {
+		return errors.New("image exceeds the limits of the segment storage")
+	}
+	if instance.active.size > 0 && instance.active.size+int64(len(data)) > SegmentSize {
+		if err = instance.rotate(); err != nil {
+			return
+		}
+	}
+	entry := segmentEntry{instance.active.id, instance.active.size, int64(len(data)), modified}
+	written, err := instance.active.file.WriteAt(data, entry.offset)
+	// partially written data is never referenced, but the space is only reclaimed by compaction
+	instance.active.size += int64(written)
+	if err != nil {
+		return
+	}
+	if err = instance.writeLog(encodeIndexEntry(indexOperationPut, key, entry)); err != nil {
+		return
+	}
+	if previous, ok := instance.index[key]; ok {
+		instance.segments[previous.segment].live -= previous.size
+	}
+	instance.index[key] = entry
+	instance.active.live += entry.size
+	return
+}
+
+func (instance *SegmentStorage) Get(key string) (reader io.ReadCloser, info StorageInfo, err error) {
+	instance.mutex.RLock()
+	entry, ok := instance.index[key]
+	var current *segment
+	if ok {
+		current = instance.segments[entry.segment]
+		current.acquire()
+	}
+	instance.mutex.RUnlock()
+	if !ok {
+		err = fs.ErrNotExist
+		return
+	}
+	return &segmentReader{io.NewSectionReader(current.file, entry.offset, entry.size), current}, StorageInfo{entry.size, time.Unix(0, entry.modified)}, nil
+}
+
+func (instance *SegmentStorage) Put(key string) (writer StorageWriter, err error) {
+	return &segmentWriter{storage: instance, key: key}, nil
+}
+
+func (instance *SegmentStorage) Stat(key string) (info StorageInfo, err error) {
+	instance.mutex.RLock()
+	entry, ok := instance.index[key]
+	instance.mutex.RUnlock()
+	if !ok {
+		err = fs.ErrNotExist
+		return
+	}
+	return StorageInfo{entry.size, time.Unix(0, entry.modified)}, nil
+}
+
+func (instance *SegmentStorage) Delete(key string) (err error) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	entry, ok := instance.index[key]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if err = instance.writeLog(encodeIndexEntry(indexOperationDelete, key, segmentEntry{})); err != nil {
+		return
+	}
+	instance.segments[entry.segment].live -= entry.size
+	delete(instance.index, key)
+	return
+}
+
+func (instance *SegmentStorage) Walk(prefix string, callback func(key string, info StorageInfo) error) error {
+	// walk a snapshot of the keys, so the callback may modify the storage
+	instance.mutex.RLock()
+	keys := make([]string, 0, len(instance.index))
+	for key := range instance.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	instance.mutex.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		info, err := instance.Stat(key)
+		if err != nil {
+			continue
+		}
+		if err = callback(key, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify that the directory of the storage is writable (a buffered Put can't detect a broken disk).
+func (instance *SegmentStorage) Check() error {
+	probe, err := os.CreateTemp(instance.directory, ".probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Move the live images of sparse segments into the active segment, remove empty segments and rewrite the index log when it's mostly obsolete.
+func (instance *SegmentStorage) compact() {
+	instance.mutex.RLock()
+	var candidates []*segment
+	for _, current := range instance.segments {
+		if current != instance.active && (current.live == 0 || float64(current.live) < compactRatio*float64(current.size)) {
+			candidates = append(candidates, current)
+		}
+	}
+	instance.mutex.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].id < candidates[j].id
+	})
+	for _, current := range candidates {
+		if err := instance.compactSegment(current); err != nil {
+			log.Warn("Failed to compact segment", instance.segmentLocation(current.id), err)
+			return
+		}
+	}
+
+	instance.mutex.RLock()
+	rewrite := instance.logEntries > indexLogRatio*int64(len(instance.index))+indexLogMargin
+	instance.mutex.RUnlock()
+	if rewrite {
+		if err := instance.rewriteLog(); err != nil {
+			log.Warn("Failed to rewrite index log of segment storage", instance.directory, err)
+		}
+	}
+}
+
+func (instance *SegmentStorage) compactSegment(current *segment) (err error) {
+	instance.mutex.RLock()
+	keys := make(map[string]segmentEntry)
+	for key, entry := range instance.index {
+		if entry.segment == current.id {
+			keys[key] = entry
+		}
+	}
+	instance.mutex.RUnlock()
+	var moved int64
+	for key, entry := range keys {
+		data := make([]byte, entry.size)
+		if _, err = current.file.ReadAt(data, entry.offset); err != nil {
+			return
+		}
+		instance.mutex.Lock()
+		// the image might have been deleted or overwritten in the meantime
+		if instance.index[key] == entry {
+			if err = instance.append(key, data, entry.modified); err == nil {
+				moved += entry.size
+			}
+		}
+		instance.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	instance.mutex.Lock()
+	if current.live > 0 {
+		instance.mutex.Unlock()
+		return
+	}
+	delete(instance.segments, current.id)
+	// the removal must happen after the moved images and their index entries were persisted
+	instance.active.file.Sync()
+	instance.log.Sync()
+	instance.mutex.Unlock()
+	current.retire()
+	log.Verbose("Compacted segment", instance.segmentLocation(current.id)+":", moved, "bytes moved,", current.size-moved, "bytes reclaimed")
+	return os.Remove(instance.segmentLocation(current.id))
+}
+
+// Replace the index log by the current content of the index.
+// The new log is written from a snapshot of the index without holding the lock, entries written meanwhile are appended before the logs are swapped.
+func (instance *SegmentStorage) rewriteLog() (err error) {
+	instance.mutex.Lock()
+	snapshot := make(map[string]segmentEntry, len(instance.index))
+	for key, entry := range instance.index {
+		snapshot[key] = entry
+	}
+	instance.rewriting, instance.logTail = true, nil
+	instance.mutex.Unlock()
+
+	location := filepath.Join(instance.directory, indexLogFile)
+	output, err := os.CreateTemp(instance.directory, ".index-*")
+	if err != nil {
+		instance.mutex.Lock()
+		instance.rewriting, instance.logTail = false, nil
+		instance.mutex.Unlock()
+		return
+	}
+	writer := bufio.NewWriterSize(output, 1024*1024)
+	for key, entry := range snapshot {
+		if _, err = writer.Write(encodeIndexEntry(indexOperationPut, key, entry)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = output.Sync()
+	}
+
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+	tail := instance.logTail
+	instance.rewriting, instance.logTail = false, nil
+	if err == nil && len(tail) > 0 {
+		if _, err = output.Write(bytes.Join(tail, nil)); err == nil {
+			err = output.Sync()
+		}
+	}
+	if e := output.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(output.Name(), location)
+	}
+	if err != nil {
+		os.Remove(output.Name())
+		return
+	}
+	instance.log.Close()
+	if instance.log, err = os.OpenFile(location, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	instance.logEntries = int64(len(snapshot) + len(tail))
+	return
+}
+
+type segmentReader struct {
+	*io.SectionReader
+	segment *segment
+}
+
+func (instance *segmentReader) Close() error {
+	instance.segment.release()
+	return nil
+}
+
+// Images are buffered in memory and appended to the active segment on commit, so concurrent fills don't interleave.
+type segmentWriter struct {
+	storage *SegmentStorage
+	key     string
+	buffer  bytes.Buffer
+	closed  bool
+}
+
+func (instance *segmentWriter) Write(data []byte) (int, error) {
+	if instance.closed {
+		return 0, errWriterClosed
+	}
+	return instance.buffer.Write(data)
+}
+
+func (instance *segmentWriter) Commit() error {
+	if instance.closed {
+		return errWriterClosed
+	}
+	instance.closed = true
+	instance.storage.mutex.Lock()
+	defer instance.storage.mutex.Unlock()
+	return instance.storage.append(instance.key, instance.buffer.Bytes(), time.Now().UnixNano())
+}
+
+func (instance *segmentWriter) Abort() {
+	instance.closed = true
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func putSegmentImage(t *testing.T, storage *SegmentStorage, key string, data []byte) {
+	writer, err := storage.Put(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(data)
+	if err = writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSegmentImage(storage *SegmentStorage, key string) (data []byte, err error) {
+	reader, _, err := storage.Get(key)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Replay the index log of the directory and compare the images with the expected ones (nil for images which must be missing).
+func checkReplayedImages(t *testing.T, directory string, expected map[string][]byte) *SegmentStorage {
+	storage, err := CreateSegmentStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range expected {
+		stored, err := readSegmentImage(storage, key)
+		if data == nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Error("image", key, "replayed from a torn entry")
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(stored, data) {
+			t.Errorf("image %s replayed as %q (%v) instead of %q", key, stored, err, data)
+		}
+	}
+	return storage
+}
+
+func TestSegmentStorageReplaysTruncatedLog(t *testing.T) {
+	directory := t.TempDir()
+	storage, err := CreateSegmentStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSegmentImage(t, storage, "ab/cd/00000001.png", []byte("first"))
+	putSegmentImage(t, storage, "ab/cd/00000002.png", []byte("second"))
+	location := filepath.Join(directory, indexLogFile)
+	info, err := os.Stat(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(location, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	storage = checkReplayedImages(t, directory, map[string][]byte{
+		"ab/cd/00000001.png": []byte("first"),
+		"ab/cd/00000002.png": nil,
+	})
+	// entries appended after the torn entry must survive the next replay
+	putSegmentImage(t, storage, "ab/cd/00000003.png", []byte("third"))
+	checkReplayedImages(t, directory, map[string][]byte{
+		"ab/cd/00000001.png": []byte("first"),
+		"ab/cd/00000002.png": nil,
+		"ab/cd/00000003.png": []byte("third"),
+	})
+}
+
+func TestSegmentStorageReplaysLogWithBadChecksum(t *testing.T) {
+	directory := t.TempDir()
+	storage, err := CreateSegmentStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSegmentImage(t, storage, "ab/cd/00000001.png", []byte("first"))
+	putSegmentImage(t, storage, "ab/cd/00000002.png", []byte("second"))
+	putSegmentImage(t, storage, "ab/cd/00000003.png", []byte("third"))
+	location := filepath.Join(directory, indexLogFile)
+	data, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt the second entry (all entries have the same size), the entries from there on can't be trusted
+	data[len(data)/2] ^= 0xFF
+	if err = os.WriteFile(location, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checkReplayedImages(t, directory, map[string][]byte{
+		"ab/cd/00000001.png": []byte("first"),
+		"ab/cd/00000002.png": nil,
+		"ab/cd/00000003.png": nil,
+	})
+	if info, err := os.Stat(location); err != nil || info.Size() != int64(len(data)/3) {
+		t.Fatal("index log not truncated after the last valid entry", info.Size(), err)
+	}
+}
+
+func TestSegmentStorageCompactsDuringWrites(t *testing.T) {
+	directory := t.TempDir()
+	storage, err := CreateSegmentStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const images = 200
+	keys := make([]string, images)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ab/cd/%08x.png", i)
+		putSegmentImage(t, storage, keys[i], []byte("original "+keys[i]))
+	}
+	storage.mutex.Lock()
+	sealed := storage.active
+	err = storage.rotate()
+	storage.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// overwrite and delete images of the sealed segment while it's compacted
+	expected := make(map[string][]byte)
+	var group sync.WaitGroup
+	group.Add(2)
+	go func() {
+		defer group.Done()
+		if err := storage.compactSegment(sealed); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer group.Done()
+		for i, key := range keys {
+			switch i % 3 {
+			case 0:
+				data := []byte("overwritten " + key)
+				putSegmentImage(t, storage, key, data)
+				expected[key] = data
+			case 1:
+				if err := storage.Delete(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					t.Error(err)
+				}
+				expected[key] = nil
+			default:
+				expected[key] = []byte("original " + key)
+			}
+		}
+	}()
+	group.Wait()
+
+	storage.mutex.RLock()
+	live := make(map[uint32]int64)
+	for key, entry := range storage.index {
+		if entry.segment == sealed.id {
+			t.Error("image", key, "still in the compacted segment")
+		}
+		live[entry.segment] += entry.size
+	}
+	for id, current := range storage.segments {
+		if current.live != live[id] {
+			t.Errorf("segment %d accounts %d live bytes instead of %d", id, current.live, live[id])
+		}
+	}
+	_, remaining := storage.segments[sealed.id]
+	storage.mutex.RUnlock()
+	if remaining {
+		t.Fatal("compacted segment not removed")
+	}
+	if _, err = os.Stat(storage.segmentLocation(sealed.id)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("file of the compacted segment not removed", err)
+	}
+	for key, data := range expected {
+		stored, err := readSegmentImage(storage, key)
+		if data == nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Error("deleted image", key, "restored by the compaction")
+			}
+		} else if err != nil || !bytes.Equal(stored, data) {
+			t.Errorf("image %s is %q (%v) instead of %q", key, stored, err, data)
+		}
+	}
+	checkReplayedImages(t, directory, expected)
+}
+
+func TestSegmentStorageRewritesLogDuringWrites(t *testing.T) {
+	directory := t.TempDir()
+	storage, err := CreateSegmentStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const images = 2000
+	keys := make([]string, images)
+	expected := make(map[string][]byte)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ab/cd/%08x.png", i)
+		expected[keys[i]] = []byte("original " + keys[i])
+		putSegmentImage(t, storage, keys[i], expected[keys[i]])
+	}
+
+	// overwrite and delete images while the index log is rewritten
+	var group sync.WaitGroup
+	group.Add(2)
+	go func() {
+		defer group.Done()
+		if err := storage.rewriteLog(); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer group.Done()
+		for i, key := range keys {
+			switch i % 3 {
+			case 0:
+				data := []byte("overwritten " + key)
+				putSegmentImage(t, storage, key, data)
+				expected[key] = data
+			case 1:
+				if err := storage.Delete(key); err != nil {
+					t.Error(err)
+				}
+				expected[key] = nil
+			}
+		}
+	}()
+	group.Wait()
+
+	storage.mutex.RLock()
+	rewriting, entries := storage.rewriting, storage.logEntries
+	storage.mutex.RUnlock()
+	if rewriting || entries > images+2*images/3+1 {
+		t.Fatal("index log not rewritten:", entries, "entries")
+	}
+	// writes after the rewrite go to the new log
+	putSegmentImage(t, storage, "ef/01/after.png", []byte("after"))
+	expected["ef/01/after.png"] = []byte("after")
+	checkReplayedImages(t, directory, expected)
+}
+
+func TestSegmentStorageUsageOfRoot(t *testing.T) {
+	storage, err := CreateSegmentStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := createCacheRoots([]CacheRoot{{Directory: storage.directory, Limit: 1000, Storage: storage}}, HotTier).roots[0]
+	data := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 10; i++ {
+		putSegmentImage(t, storage, fmt.Sprintf("ab/cd/%08d.png", i), data)
+		root.account(100)
+	}
+	for i := 0; i < 5; i++ {
+		if err = storage.Delete(fmt.Sprintf("ab/cd/%08d.png", i)); err != nil {
+			t.Fatal(err)
+		}
+		root.account(-100)
+	}
+	// the space of the deleted images is only reclaimed by compaction
+	if usage := root.usage(); usage != 1000 {
+		t.Fatal("root reports a usage of", usage, "bytes instead of the size of its segments")
+	}
+	if !root.exhausted() {
+		t.Fatal("root accepts new images although its segments reached the limit")
+	}
+	// the remaining images are below the low watermark, so nothing is demoted
+	if excess := demotionExcess(root); excess > 0 {
+		t.Fatal("demotion of", excess, "bytes would not reclaim the space of the deleted images")
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// default max. size of an image received from the upstream server
+	MaxImageSize int64 = 32 * 1024 * 1024
+	// number of bytes which are inspected for the signature of an image
+	signatureLength int = 12
+)
+
+// Headers of the upstream server which are never forwarded to clients (hop-by-hop headers and headers affecting the whole origin).
+var strippedHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Alt-Svc", "Set-Cookie", "Strict-Transport-Security", "Public-Key-Pins", "Server", "Via",
+}
+
+// Copy the headers of the upstream response which are safe to forward to the client.
+func copyUpstreamHeaders(source http.Header, destination http.Header) {
+	stripped := make(map[string]bool, len(strippedHeaders))
+	for _, key := range strippedHeaders {
+		stripped[http.CanonicalHeaderKey(key)] = true
+	}
+	// headers listed in the Connection header are hop-by-hop as well
+	for _, value := range source.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			stripped[http.CanonicalHeaderKey(strings.TrimSpace(key))] = true
+		}
+	}
+	for key, values := range source {
+		if stripped[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		for _, value := range values {
+			destination.Add(key, value)
+		}
+	}
+}
+
+// Check the type and size of an image received from the upstream server and whether its signature matches the file extension.
+// Provides the body of the response including the already inspected bytes.
+func validateUpstreamImage(source *http.Response, file string, limit int64) (body io.Reader, err error) {
+	mediaType, _, err := mime.ParseMediaType(source.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		err = fmt.Errorf("unexpected content type %q", source.Header.Get("Content-Type"))
+		return
+	}
+	if limit > 0 && source.ContentLength > limit {
+		err = fmt.Errorf("image exceeds the max. size (%d > %d bytes)", source.ContentLength, limit)
+		return
+	}
+	head := make([]byte, signatureLength)
+	read, err := io.ReadFull(source.Body, head)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	head = head[:read]
+	if !matchMagicBytes(filepath.Ext(file), head) {
+		err = errors.New("content doesn't match the file extension " + filepath.Ext(file))
+		return
+	}
+	return io.MultiReader(bytes.NewReader(head), source.Body), nil
+}
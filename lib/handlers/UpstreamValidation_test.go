@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateUpstreamImage(t *testing.T) {
+	tests := []struct {
+		file     string
+		body     string
+		accepted bool
+	}{
+		{"image.png", "\x89PNG\r\n\x1a\nrest", true},
+		{"image.jpg", "\xff\xd8\xff\xe0rest", true},
+		{"image.jpeg", "\xff\xd8\xff\xe0rest", true},
+		{"image.gif", "GIF89arest", true},
+		{"image.webp", "RIFF\x00\x00\x00\x00WEBPrest", true},
+		{"image.webp", "RIFF\x00\x00\x00\x00WAVErest", false},
+		{"image.png", "\xff\xd8\xff\xe0rest", false},
+		{"image.png", "\x89PNG", false},
+		{"image.bmp", "BMrest", false},
+	}
+	for _, test := range tests {
+		source := &http.Response{Header: make(http.Header), Body: io.NopCloser(strings.NewReader(test.body)), ContentLength: int64(len(test.body))}
+		source.Header.Set("Content-Type", "image/whatever")
+		body, err := validateUpstreamImage(source, test.file, MaxImageSize)
+		if (err == nil) != test.accepted {
+			t.Errorf("%s with %q: accepted %v, expected %v (%v)", test.file, test.body, err == nil, test.accepted, err)
+			continue
+		}
+		if err == nil {
+			if data, _ := io.ReadAll(body); string(data) != test.body {
+				t.Errorf("%s: body changed to %q", test.file, data)
+			}
+		}
+	}
+}